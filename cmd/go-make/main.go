@@ -2,42 +2,91 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/rs/zerolog/log"
 	"github.com/tobiash/go-make/pkg/mk"
 	"github.com/tobiash/go-make/pkg/mk/frontends/yamlfe"
 	"github.com/tobiash/go-make/pkg/mk/shell"
 	"github.com/urfave/cli/v2"
+	"io"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 )
 
+// exit codes as used by GNU make
+const (
+	exitOutOfDate = 1
+	exitError     = 2
+)
+
+var outputModes = map[string]shell.OutputMode{
+	"log":    shell.OutputLog,
+	"stream": shell.OutputStream,
+	"target": shell.OutputTarget,
+}
+
+var graphFormats = map[string]func(*mk.DAG, io.Writer, map[string]mk.NodeInfo) error{
+	"dot":  (*mk.DAG).WriteDOT,
+	"json": (*mk.DAG).WriteJSON,
+}
+
 func main() {
 	wd, _ := os.Getwd()
 	app := &cli.App{
 		Name: "go-make",
 		Action: func(c *cli.Context) error {
-			mkfile, err := Makefile(c)
+			m, executor, targets, err := Setup(c)
 			if err != nil {
 				return err
 			}
-			rules, err := mkfile.BuildRules()
-			if err != nil {
-				return err
-			}
-			m := mk.Make{
-				Sum:   &mk.YamlSumStorageFile{Path: filepath.Join(c.Path("directory"), c.Path("sumfile")), Perm: 0644},
-				Rules: rules,
+			var trace *mk.ChromeTrace
+			if c.Path("trace") != "" {
+				trace = &mk.ChromeTrace{}
+				m.Events = trace
 			}
-			targets := make([]mk.Target, c.NArg())
-			for i := 0; i < c.Args().Len(); i++ {
-				targets[i] = &mk.FileTarget{Dir: c.Path("directory"), Path: c.Args().Get(i)}
+			ctx, cancel := interruptible()
+			defer cancel()
+			err = m.Make(executor, ctx, targets...)
+			if trace != nil {
+				if werr := writeTrace(c.Path("trace"), trace); err == nil {
+					err = werr
+				}
 			}
-
-			ctx := log.Logger.WithContext(context.Background())
-
-			return m.Make(&shell.ShellExecutor{
-				Dir: c.Path("directory"),
-			}, ctx, targets...)
+			return err
+		},
+		Commands: []*cli.Command{
+			{
+				Name:      "graph",
+				Usage:     "print the graph of the targets and their prerequisites without making anything",
+				ArgsUsage: "[targets]",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "format",
+						Usage: "format of the graph: dot or json",
+						Value: "dot",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					write, ok := graphFormats[c.String("format")]
+					if !ok {
+						return fmt.Errorf("unknown graph format '%s'", c.String("format"))
+					}
+					m, executor, targets, err := Setup(c)
+					if err != nil {
+						return err
+					}
+					ctx, cancel := interruptible()
+					defer cancel()
+					dag, nodes, err := m.Graph(executor, ctx, targets...)
+					if err != nil {
+						return err
+					}
+					return write(dag, os.Stdout, nodes)
+				},
+			},
 		},
 		Flags: []cli.Flag{
 			&cli.PathFlag{
@@ -55,13 +104,142 @@ func main() {
 				Aliases: []string{"s"},
 				Value:   "go-make.sum",
 			},
+			&cli.DurationFlag{
+				Name:  "lock-timeout",
+				Usage: "time to wait for another go-make using the same sum file, 0 waits indefinitely, a negative value not at all",
+			},
+			&cli.IntFlag{
+				Name:    "jobs",
+				Aliases: []string{"j"},
+				Usage:   "number of targets to make in parallel, defaults to the number of CPUs",
+			},
+			&cli.BoolFlag{
+				Name:    "keep-going",
+				Aliases: []string{"k"},
+				Usage:   "keep making targets that do not depend on a failed one",
+			},
+			&cli.BoolFlag{
+				Name:    "dry-run",
+				Aliases: []string{"n", "just-print"},
+				Usage:   "print the recipes that would be executed without executing them",
+			},
+			&cli.StringFlag{
+				Name:    "output",
+				Aliases: []string{"O"},
+				Usage:   "how to show the output of recipes: stream (prefixed by target), target (all at once when done) or log",
+				Value:   "stream",
+			},
+			&cli.BoolFlag{
+				Name:    "question",
+				Aliases: []string{"q"},
+				Usage:   "execute nothing, exit with status 1 if any target is out of date",
+			},
+			&cli.BoolFlag{
+				Name:    "always-make",
+				Aliases: []string{"B"},
+				Usage:   "make all targets with a rule, even if they are up-to-date",
+			},
+			&cli.PathFlag{
+				Name:  "trace",
+				Usage: "write the durations of checking and making targets to a file in the Chrome Trace Event Format",
+			},
+			&cli.BoolFlag{
+				Name:  "explain",
+				Usage: "print why each target is made",
+			},
 		},
 	}
 
 	err := app.Run(os.Args)
+	var outOfDate *mk.OutOfDateError
+	switch {
+	case errors.As(err, &outOfDate):
+		log.Info().Err(err).Msg("targets out of date")
+		os.Exit(exitOutOfDate)
+	case err != nil:
+		log.Error().Err(err).Msg("application failed")
+		os.Exit(exitError)
+	}
+}
+
+// Setup creates the Make and executor configured by the flags of the app and parses the targets
+// given as arguments
+func Setup(c *cli.Context) (*mk.Make, *shell.ShellExecutor, []mk.Target, error) {
+	mkfile, err := Makefile(c)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	rules, err := mkfile.BuildRules()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	output, ok := outputModes[c.String("output")]
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("unknown output mode '%s'", c.String("output"))
+	}
+	m := &mk.Make{
+		Sum: &mk.YamlSumStorageFile{
+			Path:        filepath.Join(c.Path("directory"), c.Path("sumfile")),
+			Perm:        0644,
+			LockTimeout: c.Duration("lock-timeout"),
+		},
+		Rules:      rules,
+		Jobs:       c.Int("jobs"),
+		KeepGoing:  c.Bool("keep-going"),
+		DryRun:     c.Bool("dry-run"),
+		Question:   c.Bool("question"),
+		AlwaysMake: c.Bool("always-make"),
+		Pools:      mkfile.Pools,
+	}
+	if c.Bool("explain") {
+		m.Explain = func(target mk.Target, reason mk.Reason) {
+			fmt.Fprintf(os.Stderr, "go-make explain: %s: %s\n", target.Name(), reason)
+		}
+	}
+	targets := make([]mk.Target, c.NArg())
+	for i := 0; i < c.Args().Len(); i++ {
+		if targets[i], err = mkfile.Target(c.Args().Get(i)); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	return m, &shell.ShellExecutor{
+		ShellCmd: mkfile.Shell,
+		Dir:      c.Path("directory"),
+		Output:   output,
+	}, targets, nil
+}
+
+// interruptible returns a context that is cancelled on SIGINT or SIGTERM. Only the first signal
+// is handled, a second one terminates the process right away.
+func interruptible() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(log.Logger.WithContext(context.Background()))
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-signals:
+			signal.Stop(signals)
+			log.Warn().Msg("interrupted, stopping recipes, interrupt again to quit")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(signals)
+		cancel()
+	}
+}
+
+func writeTrace(path string, trace *mk.ChromeTrace) error {
+	f, err := os.Create(path)
 	if err != nil {
-		log.Fatal().Err(err).Msg("application failed")
+		return err
+	}
+	if err := trace.Write(f); err != nil {
+		_ = f.Close()
+		return err
 	}
+	return f.Close()
 }
 
 func Makefile(c *cli.Context) (*yamlfe.Makefile, error) {
@@ -74,5 +252,6 @@ func Makefile(c *cli.Context) (*yamlfe.Makefile, error) {
 	if err = mkfile.Parse(f); err != nil {
 		return nil, err
 	}
+	mkfile.Dir = c.Path("directory")
 	return &mkfile, nil
 }
@@ -2,47 +2,207 @@ package mk
 
 import (
 	"context"
+	"fmt"
 	"github.com/rs/zerolog"
-	"golang.org/x/sync/errgroup"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
+// WalkMode determines how a walk proceeds after the walk function failed for a target
+type WalkMode int
+
+const (
+	// FailFast cancels the walk on the first error
+	FailFast WalkMode = iota
+	// KeepGoing continues with every target not depending on a failed one, skipping the rest
+	KeepGoing
+)
+
+// DAG is a graph of targets with edges to their prerequisites. Targets are identified by name, the
+// first value added for a name is the one used for it.
 type DAG struct {
-	graph  map[Target]map[Target]bool
-	Logger *zerolog.Logger
+	graph   map[Target]map[Target]bool
+	targets map[string]Target
+	// required are the targets with an edge to them
+	required map[Target]bool
+	Logger   *zerolog.Logger
+	Mode     WalkMode
+	// Events, if set, receives the queued, started, succeeded, failed and skipped events of walks
+	Events EventSink
+	// Cost, if set, estimates how long the walk function takes for a target. Walks with several
+	// workers process the ready target with the longest remaining path first, which without costs
+	// is the deepest one.
+	Cost func(Target) time.Duration
+	// Pools are resource pools with the number of units each one has
+	Pools map[string]int
+	// Units, if set, returns the units of Pools the walk function needs for a target. Walks only
+	// hand out targets to workers while the pools have enough free units left, holding them until
+	// the walk function returns.
+	Units func(Target) map[string]int
 }
 
 func NewDAG() *DAG {
-	return &DAG{map[Target]map[Target]bool{}, nil}
+	return &DAG{graph: map[Target]map[Target]bool{}, targets: map[string]Target{}, required: map[Target]bool{}}
+}
+
+// Target returns the target of the graph with the given name
+func (g *DAG) Target(name string) (Target, bool) {
+	t, ok := g.targets[name]
+	return t, ok
+}
+
+// node returns the value used for a target with the same name as the given one, if there is one
+func (g *DAG) node(t Target) Target {
+	if n, ok := g.targets[t.Name()]; ok {
+		return n
+	}
+	return t
 }
 
-func (g *DAG) AddTarget(t Target, prereqs []Target) {
+// TargetError is the error of the walk function for a single target
+type TargetError struct {
+	Target Target
+	Err    error
+}
+
+func (e *TargetError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Target.Name(), e.Err)
+}
+
+func (e *TargetError) Unwrap() error {
+	return e.Err
+}
+
+// WalkError aggregates the outcome of a walk in KeepGoing mode: every target the walk function
+// failed for, and every target skipped because it depends on one of those.
+type WalkError struct {
+	Failed  []*TargetError
+	Skipped []Target
+}
+
+func (e *WalkError) Error() string {
+	failed := make([]string, len(e.Failed))
+	for i := range e.Failed {
+		failed[i] = e.Failed[i].Error()
+	}
+	msg := fmt.Sprintf("%d target(s) failed: %s", len(e.Failed), strings.Join(failed, "; "))
+	if len(e.Skipped) > 0 {
+		skipped := make([]string, len(e.Skipped))
+		for i := range e.Skipped {
+			skipped[i] = e.Skipped[i].Name()
+		}
+		msg += fmt.Sprintf("; %d target(s) skipped: %s", len(e.Skipped), strings.Join(skipped, ", "))
+	}
+	return msg
+}
+
+// CycleError is returned when an edge would turn the graph cyclic. Path lists the targets
+// forming the cycle, starting and ending with the same target.
+type CycleError struct {
+	Path []Target
+}
+
+func (e *CycleError) Error() string {
+	names := make([]string, len(e.Path))
+	for i := range e.Path {
+		names[i] = e.Path[i].Name()
+	}
+	return fmt.Sprintf("dependency cycle: %s", strings.Join(names, " -> "))
+}
+
+// AddTarget adds a target and edges to its prerequisites. If any of the edges would introduce a
+// cycle, the graph is left unchanged and a *CycleError is returned.
+func (g *DAG) AddTarget(t Target, prereqs []Target) error {
+	t = g.node(t)
+	nodes := make([]Target, len(prereqs))
+	// a new edge can only close a cycle if the target is required by another one and the
+	// prerequisite has prerequisites itself, so adding targets bottom-up or top-down needs no search
+	visited := map[Target]bool{}
+	for i, p := range prereqs {
+		nodes[i] = g.node(p)
+		if nodes[i] != t && (!g.required[t] || len(g.graph[nodes[i]]) == 0) {
+			continue
+		}
+		if path := g.path(nodes[i], t, visited); path != nil {
+			return &CycleError{Path: append([]Target{t}, path...)}
+		}
+	}
+	for _, p := range nodes {
+		g.addEdge(t, p)
+	}
+	g.addNode(t)
+	return nil
+}
+
+func (g *DAG) addNode(t Target) {
 	if g.graph[t] == nil {
 		g.graph[t] = map[Target]bool{}
+		g.targets[t.Name()] = t
 	}
+}
+
+// addEdge adds an edge without checking for cycles
+func (g *DAG) addEdge(t, p Target) {
+	g.addNode(t)
+	g.addNode(p)
+	g.graph[t][p] = true
+	g.required[p] = true
+}
 
-	for _, p := range prereqs {
-		if g.graph[p] == nil {
-			g.graph[p] = map[Target]bool{}
+// path returns a chain of edges leading from one target to another (both included), or nil if
+// there is none. Targets in visited are known not to lead to the other one and are skipped, it is
+// updated with the targets searched.
+func (g *DAG) path(from, to Target, visited map[Target]bool) []Target {
+	var visit func(u Target) []Target
+	visit = func(u Target) []Target {
+		if u == to {
+			return []Target{u}
 		}
-		g.graph[t][p] = true
+		if visited[u] {
+			return nil
+		}
+		visited[u] = true
+		for v := range g.graph[u] {
+			if p := visit(v); p != nil {
+				return append([]Target{u}, p...)
+			}
+		}
+		return nil
+	}
+	return visit(from)
+}
+
+func (g *DAG) log() *zerolog.Logger {
+	if g.Logger == nil {
+		nop := zerolog.Nop()
+		return &nop
 	}
+	return g.Logger
 }
 
 func (g *DAG) reverse() *DAG {
 	n := NewDAG()
 	n.Logger = g.Logger
+	n.Mode = g.Mode
+	n.Events = g.Events
+	n.Cost = g.Cost
+	n.Pools = g.Pools
+	n.Units = g.Units
+	// reversing the edges of an acyclic graph cannot introduce a cycle
 	for target, prereq := range g.graph {
+		n.addNode(target)
 		for p := range prereq {
-			n.AddTarget(p, []Target{target})
-		}
-		if len(prereq) == 0 {
-			n.AddTarget(target, nil)
+			n.addEdge(p, target)
 		}
 	}
 	return n
 }
 
-func (g *DAG) TopographicalSort() []Target {
+// TopographicalSort orders the targets such that every target precedes its prerequisites. If the
+// graph contains a cycle, a *CycleError is returned along with the targets that could be ordered.
+func (g *DAG) TopographicalSort() ([]Target, error) {
 	var linearOrder []Target
 
 	inDegree := map[Target]int{}
@@ -79,14 +239,75 @@ func (g *DAG) TopographicalSort() []Target {
 		}
 	}
 
-	return linearOrder
+	if len(linearOrder) < len(g.graph) {
+		return linearOrder, g.cycle(inDegree)
+	}
+	return linearOrder, nil
+}
+
+// cycle finds a cycle among the targets left with a non-zero in-degree by a topographical sort
+func (g *DAG) cycle(inDegree map[Target]int) error {
+	for u := range inDegree {
+		if inDegree[u] == 0 {
+			continue
+		}
+		for v := range g.graph[u] {
+			if path := g.path(v, u, map[Target]bool{}); path != nil {
+				return &CycleError{Path: append([]Target{u}, path...)}
+			}
+		}
+	}
+	return fmt.Errorf("dependency cycle")
 }
 
 func (g *DAG) WalkUp(ctx context.Context, nWorkers int, fn func(context.Context, Target) error) error {
 	return g.reverse().WalkDown(ctx, nWorkers, fn)
 }
 
+type walkResult struct {
+	target Target
+	err    error
+}
+
+// WalkDown calls fn for every target using nWorkers parallel workers, calling it for a target only
+// after it has returned for every target with an edge to it. How errors are handled depends on the
+// DAG's Mode. The context passed to fn tells the worker calling it, see WorkerID. Ready targets
+// waiting for a worker are processed by priority, see Cost, and then by name. A walk with a single
+// worker, which no order makes faster, processes them by name only, so it is deterministic.
 func (g *DAG) WalkDown(ctx context.Context, nWorkers int, fn func(context.Context, Target) error) error {
+	if _, err := g.TopographicalSort(); err != nil {
+		return err
+	}
+	if nWorkers < 1 {
+		nWorkers = 1
+	}
+	units, err := g.poolUnits()
+	if err != nil {
+		return err
+	}
+	log := g.log()
+	var priority map[Target]time.Duration
+	if nWorkers > 1 {
+		priority = g.priorities()
+	}
+	free := make(map[string]int, len(g.Pools))
+	for name, capacity := range g.Pools {
+		free[name] = capacity
+	}
+	fits := func(u Target) bool {
+		for name, n := range units[u] {
+			if n > free[name] {
+				return false
+			}
+		}
+		return true
+	}
+	take := func(u Target, sign int) {
+		for name, n := range units[u] {
+			free[name] -= sign * n
+		}
+	}
+
 	inDegree := map[Target]int{}
 	for n := range g.graph {
 		inDegree[n] = 0
@@ -97,92 +318,194 @@ func (g *DAG) WalkDown(ctx context.Context, nWorkers int, fn func(context.Contex
 		}
 	}
 
-	gr, ctx := errgroup.WithContext(ctx)
-	next := make(chan Target, len(g.graph))
-	complete := make(chan Target)
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	next := make(chan Target)
+	complete := make(chan walkResult)
+	var wg sync.WaitGroup
+	for i := 0; i < nWorkers; i++ {
+		worker := i
+		wl := log.With().Int("worker", worker).Logger()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx := context.WithValue(wctx, workerKey{}, worker)
+			for l := range next {
+				wl.Debug().Str("target", l.Name()).Msg("processing target")
+				emit(g.Events, Event{Kind: EventStarted, Target: l, Worker: worker})
+				err := fn(ctx, l)
+				if err != nil {
+					wl.Err(err).Str("target", l.Name()).Msg("dag walk function error")
+					emit(g.Events, Event{Kind: EventFailed, Target: l, Worker: worker, Err: err})
+				} else {
+					wl.Debug().Str("target", l.Name()).Msg("target completed")
+					emit(g.Events, Event{Kind: EventSucceeded, Target: l, Worker: worker})
+				}
+				complete <- walkResult{l, err}
+			}
+			wl.Debug().Msg("worker exiting")
+		}()
+	}
 
-	gr.Go(func() error {
-		for u, v := range inDegree {
-			if v != 0 {
+	var ready []Target
+	for u, v := range inDegree {
+		if v == 0 {
+			ready = append(ready, u)
+		}
+	}
+	// queue in a stable order, as events are sent for it
+	sort.Slice(ready, func(i, j int) bool { return ready[i].Name() < ready[j].Name() })
+	for _, u := range ready {
+		log.Debug().Str("target", u.Name()).Msg("queuing initial target")
+		emit(g.Events, Event{Kind: EventQueued, Target: u, Worker: -1})
+	}
+
+	var (
+		remaining = len(inDegree)
+		running   int
+		stopped   bool
+		firstErr  error
+		failed    []*TargetError
+		skipped   []Target
+		poisoned  = map[Target]bool{}
+		done      = ctx.Done()
+	)
+	// release marks a target as finished and queues the targets becoming ready, skipping those
+	// depending on a failed target
+	var release func(u Target, failed bool)
+	release = func(u Target, failed bool) {
+		remaining--
+		for v := range g.graph[u] {
+			inDegree[v]--
+			poisoned[v] = poisoned[v] || failed
+			log.Debug().Str("prevTarget", u.Name()).Str("target", v.Name()).Int("degree", inDegree[v]).Msg("reduce degree")
+			if inDegree[v] != 0 {
 				continue
 			}
-			select {
-			case next <- u:
-				g.Logger.Debug().Str("target", u.Name()).Msg("queuing initial target")
-			case <-ctx.Done():
-				return ctx.Err()
+			if poisoned[v] {
+				log.Debug().Str("target", v.Name()).Msg("skipping target")
+				skipped = append(skipped, v)
+				emit(g.Events, Event{Kind: EventSkipped, Target: v, Worker: -1})
+				release(v, true)
+			} else {
+				log.Debug().Str("prevTarget", u.Name()).Str("target", v.Name()).Msg("queuing next")
+				ready = append(ready, v)
+				emit(g.Events, Event{Kind: EventQueued, Target: v, Worker: -1})
 			}
 		}
-		g.Logger.Debug().Msg("initial targets queued")
+	}
 
-		for {
-			// Check if done
-			done := true
-			for k := range inDegree {
-				if inDegree[k] != 0 {
-					done = false
-				}
-			}
-			if done {
-				g.Logger.Debug().Msg("closing next")
-				close(next)
-				break
+	for remaining > 0 {
+		if ctx.Err() != nil {
+			stopped, done = true, nil
+		}
+		if !stopped && running < nWorkers {
+			// fewer targets are running than there are workers, so one is waiting for the next
+			if i := nextReady(ready, priority, fits, nWorkers-running); i >= 0 {
+				take(ready[i], 1)
+				next <- ready[i]
+				ready = append(ready[:i], ready[i+1:]...)
+				running++
+				continue
 			}
-
-			select {
-			case u := <-complete:
-				g.Logger.Debug().Str("target", u.Name()).Msg("target complete")
-				for v := range g.graph[u] {
-					inDegree[v]--
-					g.Logger.Debug().Str("prevTarget", u.Name()).Str("target", v.Name()).Int("degree", inDegree[v]).Msg("reduce degree")
-					if inDegree[v] == 0 {
-						select {
-						case <-ctx.Done():
-							return ctx.Err()
-						case next <- v:
-							g.Logger.Debug().Str("prevTarget", u.Name()).Str("target", v.Name()).Msg("queuing next")
-						}
-					}
+		}
+		if running == 0 {
+			break
+		}
+		select {
+		case r := <-complete:
+			running--
+			take(r.target, -1)
+			log.Debug().Str("target", r.target.Name()).Msg("target complete")
+			if r.err != nil {
+				if firstErr == nil {
+					firstErr = r.err
+				}
+				failed = append(failed, &TargetError{Target: r.target, Err: r.err})
+				if g.Mode == FailFast {
+					stopped = true
+					cancel()
 				}
-			case <-ctx.Done():
-				return ctx.Err()
 			}
+			release(r.target, r.err != nil)
+		case <-done:
+			stopped, done = true, nil
+		}
+	}
+	log.Debug().Msg("closing next")
+	close(next)
+	wg.Wait()
+	log.Debug().Msg("all workers done")
+
+	switch {
+	case g.Mode == FailFast && firstErr != nil:
+		return firstErr
+	case ctx.Err() != nil:
+		return ctx.Err()
+	case len(failed) > 0:
+		sort.Slice(failed, func(i, j int) bool { return failed[i].Target.Name() < failed[j].Target.Name() })
+		sort.Slice(skipped, func(i, j int) bool { return skipped[i].Name() < skipped[j].Name() })
+		return &WalkError{Failed: failed, Skipped: skipped}
+	}
+	return nil
+}
+
+// nextReady returns the index of the ready target to be handed to one of the idle workers next,
+// or -1 if none fits into the free units of the pools. Priorities only matter if the fitting
+// targets have to wait for a worker, otherwise they are all handed out by name.
+func nextReady(ready []Target, priority map[Target]time.Duration, fits func(Target) bool, idle int) int {
+	fitting := 0
+	for _, u := range ready {
+		if fits(u) {
+			fitting++
 		}
-		for _ = range complete {
-			// Consume remaining completions (of root nodes) to exit gracefully
+	}
+	if fitting <= idle {
+		priority = nil
+	}
+	n := -1
+	for i := range ready {
+		if !fits(ready[i]) {
+			continue
 		}
-		return nil
-	})
+		if n < 0 {
+			n = i
+			continue
+		}
+		pi, pn := priority[ready[i]], priority[ready[n]]
+		if pi > pn || pi == pn && ready[i].Name() < ready[n].Name() {
+			n = i
+		}
+	}
+	return n
+}
 
-	wg, wctx := errgroup.WithContext(ctx)
-	for i := 0; i < nWorkers; i++ {
-		wl := g.Logger.With().Int("worker", i).Logger()
-		wg.Go(func() error {
-			for {
-				select {
-				case <-wctx.Done():
-					return wctx.Err()
-				case l, ok := <-next:
-					if !ok {
-						wl.Debug().Msg("worker exiting")
-						return nil
-					}
-					wl.Debug().Str("target", l.Name()).Msg("processing target")
-					if err := fn(wctx, l); err != nil {
-						wl.Err(err).Msg("dag walk function error")
-						return err
-					}
-					wl.Debug().Str("target", l.Name()).Msg("target completed")
-					complete <- l
-				}
+// priorities computes the length of the longest path starting at each target, weighing every
+// target by its cost or 1 if it has none
+func (g *DAG) priorities() map[Target]time.Duration {
+	priority := make(map[Target]time.Duration, len(g.graph))
+	var visit func(u Target) time.Duration
+	visit = func(u Target) time.Duration {
+		if p, ok := priority[u]; ok {
+			return p
+		}
+		var longest time.Duration
+		for v := range g.graph[u] {
+			if p := visit(v); p > longest {
+				longest = p
+			}
+		}
+		weight := time.Duration(1)
+		if g.Cost != nil {
+			if c := g.Cost(u); c > weight {
+				weight = c
 			}
-		})
+		}
+		priority[u] = weight + longest
+		return priority[u]
 	}
-
-	gr.Go(func() error {
-		g.Logger.Debug().Msg("all workers done")
-		defer close(complete)
-		return wg.Wait()
-	})
-	return gr.Wait()
+	for u := range g.graph {
+		visit(u)
+	}
+	return priority
 }
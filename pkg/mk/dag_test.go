@@ -2,9 +2,14 @@ package mk
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sort"
 	"sync"
 	"testing"
+	"time"
 )
 
 type ttarget struct {
@@ -57,3 +62,288 @@ func targetListEqual(a, b []Target) bool {
 	}
 	return true
 }
+
+func TestDAGCycle(t *testing.T) {
+	dag := NewDAG()
+	a := ttarget{"a"}
+	b := ttarget{"b"}
+	c := ttarget{"c"}
+
+	assert.NoError(t, dag.AddTarget(&a, []Target{&b}))
+	assert.NoError(t, dag.AddTarget(&b, []Target{&c}))
+	err := dag.AddTarget(&c, []Target{&a})
+	var cycleErr *CycleError
+	require.True(t, errors.As(err, &cycleErr))
+	assert.Equal(t, "dependency cycle: c -> a -> b -> c", err.Error())
+	assert.True(t, targetListEqual(cycleErr.Path, []Target{&c, &a, &b, &c}))
+
+	order, err := dag.TopographicalSort()
+	assert.NoError(t, err)
+	assert.True(t, targetListEqual(order, []Target{&a, &b, &c}))
+
+	assert.Error(t, dag.AddTarget(&a, []Target{&a}))
+}
+
+func TestDAGWalkErrors(t *testing.T) {
+	a := ttarget{"a"}
+	b := ttarget{"b"}
+	c := ttarget{"c"}
+	d := ttarget{"d"}
+	newDAG := func() *DAG {
+		dag := NewDAG()
+		assert.NoError(t, dag.AddTarget(&a, []Target{&b, &c}))
+		assert.NoError(t, dag.AddTarget(&b, []Target{&d}))
+		return dag
+	}
+	walk := func(dag *DAG) ([]Target, error) {
+		l := sync.Mutex{}
+		var rs []Target
+		err := dag.WalkUp(context.TODO(), 1, func(ctx context.Context, target Target) error {
+			l.Lock()
+			defer l.Unlock()
+			rs = append(rs, target)
+			if target == &d {
+				return errFailed
+			}
+			return nil
+		})
+		return rs, err
+	}
+
+	dag := newDAG()
+	_, err := walk(dag)
+	assert.Equal(t, errFailed, err)
+
+	dag = newDAG()
+	dag.Mode = KeepGoing
+	rs, err := walk(dag)
+	var walkErr *WalkError
+	require.True(t, errors.As(err, &walkErr))
+	assert.Len(t, rs, 2)
+	assert.Contains(t, rs, Target(&c))
+	require.Len(t, walkErr.Failed, 1)
+	assert.Equal(t, Target(&d), walkErr.Failed[0].Target)
+	assert.True(t, errors.Is(walkErr.Failed[0], errFailed))
+	assert.True(t, targetListEqual(walkErr.Skipped, []Target{&a, &b}))
+	assert.Equal(t, "1 target(s) failed: d: failed; 2 target(s) skipped: a, b", err.Error())
+}
+
+func TestDAGSerialWalk(t *testing.T) {
+	dag := NewDAG()
+	a := ttarget{"a"}
+	b := ttarget{"b"}
+	c := ttarget{"c"}
+	d := ttarget{"d"}
+	e := ttarget{"e"}
+
+	assert.NoError(t, dag.AddTarget(&a, []Target{&e, &c}))
+	assert.NoError(t, dag.AddTarget(&e, []Target{&d, &b}))
+	assert.NoError(t, dag.AddTarget(&c, []Target{&d}))
+
+	var rs []Target
+	assert.NoError(t, dag.WalkUp(context.TODO(), 1, func(ctx context.Context, target Target) error {
+		rs = append(rs, target)
+		return nil
+	}))
+	assert.True(t, targetListEqual(rs, []Target{&b, &d, &c, &e, &a}))
+}
+
+func TestDAGCriticalPath(t *testing.T) {
+	a := ttarget{"a"}
+	b := ttarget{"b"}
+	x := ttarget{"x"}
+	y := ttarget{"y"}
+	z := ttarget{"z"}
+	dag := NewDAG()
+	assert.NoError(t, dag.AddTarget(&x, []Target{&y}))
+	assert.NoError(t, dag.AddTarget(&y, []Target{&z}))
+	assert.NoError(t, dag.AddTarget(&a, nil))
+	assert.NoError(t, dag.AddTarget(&b, nil))
+	// first returns the targets two workers start with, neither returns before both started
+	first := func() []Target {
+		var lock sync.Mutex
+		var started []Target
+		var wg sync.WaitGroup
+		wg.Add(2)
+		assert.NoError(t, dag.WalkUp(context.TODO(), 2, func(ctx context.Context, target Target) error {
+			lock.Lock()
+			started = append(started, target)
+			n := len(started)
+			lock.Unlock()
+			if n <= 2 {
+				wg.Done()
+				wg.Wait()
+			}
+			return nil
+		}))
+		sort.Slice(started[:2], func(i, j int) bool { return started[i].Name() < started[j].Name() })
+		return started[:2]
+	}
+
+	// the longest chain goes first
+	assert.True(t, targetListEqual(first(), []Target{&a, &z}))
+
+	dag.Cost = func(target Target) time.Duration {
+		if target == &b {
+			return time.Minute
+		}
+		return time.Second
+	}
+	assert.True(t, targetListEqual(first(), []Target{&b, &z}))
+
+	// a single worker goes by name
+	var rs []Target
+	assert.NoError(t, dag.WalkUp(context.TODO(), 1, func(ctx context.Context, target Target) error {
+		rs = append(rs, target)
+		return nil
+	}))
+	assert.True(t, targetListEqual(rs, []Target{&a, &b, &z, &y, &x}))
+}
+
+func TestDAGEvents(t *testing.T) {
+	a := ttarget{"a"}
+	b := ttarget{"b"}
+	c := ttarget{"c"}
+	d := ttarget{"d"}
+	dag := NewDAG()
+	assert.NoError(t, dag.AddTarget(&a, []Target{&b, &c}))
+	assert.NoError(t, dag.AddTarget(&b, []Target{&d}))
+	dag.Mode = KeepGoing
+	var events []string
+	dag.Events = EventSinkFunc(func(e Event) {
+		assert.False(t, e.Time.IsZero())
+		events = append(events, e.Kind.String()+" "+e.Target.Name())
+	})
+
+	err := dag.WalkUp(context.TODO(), 1, func(ctx context.Context, target Target) error {
+		assert.Equal(t, 0, WorkerID(ctx))
+		if target == &d {
+			return errFailed
+		}
+		return nil
+	})
+	require.Error(t, err)
+	assert.Equal(t, []string{
+		"queued c", "queued d",
+		"started c", "succeeded c",
+		"started d", "failed d",
+		"skipped b", "skipped a",
+	}, events)
+	assert.Equal(t, -1, WorkerID(context.TODO()))
+}
+
+func TestDAGTargetIdentity(t *testing.T) {
+	a := ttarget{"a"}
+	b1 := ttarget{"b"}
+	b2 := ttarget{"b"}
+	c := ttarget{"c"}
+	dag := NewDAG()
+	assert.NoError(t, dag.AddTarget(&a, []Target{&b1}))
+	assert.NoError(t, dag.AddTarget(&c, []Target{&b2}))
+	b, ok := dag.Target("b")
+	require.True(t, ok)
+	assert.True(t, b == &b1)
+
+	var rs []Target
+	assert.NoError(t, dag.WalkUp(context.TODO(), 1, func(ctx context.Context, target Target) error {
+		rs = append(rs, target)
+		return nil
+	}))
+	assert.True(t, targetListEqual(rs, []Target{&b1, &a, &c}))
+
+	var cycleErr *CycleError
+	assert.True(t, errors.As(dag.AddTarget(&ttarget{"b"}, []Target{&ttarget{"c"}}), &cycleErr))
+}
+
+func TestDAGLargeWalk(t *testing.T) {
+	const n, prereqs = 4000, 5
+	targets := make([]Target, n)
+	for i := range targets {
+		targets[i] = &ttarget{fmt.Sprintf("t%04d", i)}
+	}
+	edges := func(i int) []Target {
+		var ps []Target
+		for k := 1; k <= prereqs && i-k*7 >= 0; k++ {
+			ps = append(ps, targets[i-k*7])
+		}
+		return ps
+	}
+	started := time.Now()
+	bottomUp, topDown := NewDAG(), NewDAG()
+	for i := 0; i < n; i++ {
+		require.NoError(t, bottomUp.AddTarget(targets[i], edges(i)))
+	}
+	for i := n - 1; i >= 0; i-- {
+		require.NoError(t, topDown.AddTarget(targets[i], edges(i)))
+	}
+	var cycleErr *CycleError
+	assert.True(t, errors.As(bottomUp.AddTarget(targets[(n-1)%7], []Target{targets[n-1]}), &cycleErr))
+	for _, dag := range []*DAG{bottomUp, topDown} {
+		l := sync.Mutex{}
+		count := 0
+		require.NoError(t, dag.WalkUp(context.TODO(), 4, func(ctx context.Context, target Target) error {
+			l.Lock()
+			defer l.Unlock()
+			count++
+			return nil
+		}))
+		assert.Equal(t, n, count)
+	}
+	assert.Less(t, int64(time.Since(started)), int64(5*time.Second))
+}
+
+func TestDAGPools(t *testing.T) {
+	dag := NewDAG()
+	var light []Target
+	for _, name := range []string{"h1", "h2", "l1", "l2", "l3", "l4"} {
+		target := &ttarget{name}
+		assert.NoError(t, dag.AddTarget(target, nil))
+		if name[0] == 'l' {
+			light = append(light, target)
+		}
+	}
+	dag.Pools = map[string]int{"heavy": 1}
+	dag.Units = func(target Target) map[string]int {
+		if target.Name()[0] == 'h' {
+			return map[string]int{"heavy": 1}
+		}
+		return nil
+	}
+	l := sync.Mutex{}
+	lightDone := make(chan struct{})
+	remaining := len(light)
+	heavy := 0
+	// the first heavy target only finishes once all light ones are done, which needs the second
+	// worker not to wait for the pool
+	assert.NoError(t, dag.WalkDown(context.TODO(), 2, func(ctx context.Context, target Target) error {
+		if target.Name()[0] == 'l' {
+			l.Lock()
+			defer l.Unlock()
+			if remaining--; remaining == 0 {
+				close(lightDone)
+			}
+			return nil
+		}
+		l.Lock()
+		heavy++
+		running := heavy
+		l.Unlock()
+		assert.Equal(t, 1, running)
+		select {
+		case <-lightDone:
+		case <-time.After(5 * time.Second):
+			t.Error("light targets were not made while a heavy one was running")
+		}
+		l.Lock()
+		heavy--
+		l.Unlock()
+		return nil
+	}))
+
+	dag.Units = func(target Target) map[string]int {
+		return map[string]int{"heavy": 2}
+	}
+	assert.EqualError(t, dag.WalkDown(context.TODO(), 2, func(ctx context.Context, target Target) error {
+		return nil
+	}), "target 'h1' needs 2 units of pool 'heavy', but it only has 1")
+}
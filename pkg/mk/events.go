@@ -0,0 +1,86 @@
+package mk
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// EventKind tells what happened in a build
+type EventKind int
+
+const (
+	// EventGraphComputed is sent once the DAG of a build is known, before any target is processed
+	EventGraphComputed EventKind = iota
+	// EventQueued is sent when all prerequisites of a target are done and it waits for a worker
+	EventQueued
+	// EventStarted is sent when a worker starts processing a target
+	EventStarted
+	// EventUpToDate is sent for a target that does not need to be made
+	EventUpToDate
+	// EventExecuting is sent before the recipe of an out-of-date target is executed
+	EventExecuting
+	// EventSucceeded is sent when a worker is done processing a target, whether it was made or not
+	EventSucceeded
+	// EventFailed is sent when processing a target failed
+	EventFailed
+	// EventSkipped is sent for a target that is not processed because a prerequisite failed
+	EventSkipped
+)
+
+var eventKindNames = []string{"graph computed", "queued", "started", "up-to-date", "executing", "succeeded", "failed", "skipped"}
+
+func (k EventKind) String() string {
+	if k < 0 || int(k) >= len(eventKindNames) {
+		return fmt.Sprintf("unknown event %d", k)
+	}
+	return eventKindNames[k]
+}
+
+// Event is something that happened in a build
+type Event struct {
+	Kind EventKind
+	Time time.Time
+	// Target is the target the event is about, nil for EventGraphComputed
+	Target Target
+	// Worker is the ID of the worker processing the target, -1 for events not sent by a worker
+	Worker int
+	// Targets is the number of targets in the graph for EventGraphComputed
+	Targets int
+	// Reason tells why the target is made for EventExecuting
+	Reason Reason
+	// Err is the error of the target for EventFailed
+	Err error
+}
+
+// EventSink receives the events of a build. It may be called concurrently from several workers.
+type EventSink interface {
+	Event(e Event)
+}
+
+// EventSinkFunc is an EventSink calling a function
+type EventSinkFunc func(e Event)
+
+func (f EventSinkFunc) Event(e Event) {
+	f(e)
+}
+
+type workerKey struct{}
+
+// WorkerID returns the ID of the worker of a DAG walk processing a target given the context passed
+// to the walk function, or -1 if the context is not the one of a worker
+func WorkerID(ctx context.Context) int {
+	if id, ok := ctx.Value(workerKey{}).(int); ok {
+		return id
+	}
+	return -1
+}
+
+// emit sends an event to the sink, if there is one, setting its time
+func emit(sink EventSink, e Event) {
+	if sink == nil {
+		return
+	}
+	e.Time = time.Now()
+	sink.Event(e)
+}
@@ -9,7 +9,9 @@ import (
 	"io"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
 )
 
 // A target on the filesystem (directory or file)
@@ -20,12 +22,18 @@ type FileTarget struct {
 
 func init() {
 	RegisterTarget("file", func(u url.URL) Target {
-		return &FileTarget{Path: u.Path}
+		return &FileTarget{Path: filepath.FromSlash(urlPath(u))}
 	})
 }
 
+// Name is the file URL of the cleaned path, so different spellings of a path, e.g. ./a and b/../a,
+// name the same target
 func (f *FileTarget) Name() string {
-	return (&url.URL{Path: filepath.ToSlash(f.Path), Scheme: "file"}).String()
+	p := filepath.ToSlash(f.Path)
+	if p != "" {
+		p = path.Clean(p)
+	}
+	return (&url.URL{Path: p, Scheme: "file"}).String()
 }
 
 func (f *FileTarget) Check(digest string) (TargetStatus, error) {
@@ -69,3 +77,16 @@ func fileHash(p string) ([]byte, error) {
 	}
 	return h.Sum(nil), nil
 }
+
+// urlPath returns the path of a target URL. Relative paths are either opaque (file:dir/a.txt) or,
+// as in the names of file targets, start with the host (file://dir/a.txt).
+func urlPath(u url.URL) string {
+	if u.Opaque == "" {
+		return u.Host + u.Path
+	}
+	p, err := url.PathUnescape(u.Opaque)
+	if err != nil {
+		p = u.Opaque
+	}
+	return strings.TrimPrefix(p, "//")
+}
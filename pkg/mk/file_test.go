@@ -36,3 +36,12 @@ func TestFileCheck(t *testing.T) {
 	assert.False(t, status.UpToDate)
 	assert.Equal(t, digest, status.CurrentDigest)
 }
+
+func TestFileName(t *testing.T) {
+	assert.Equal(t, "file://a.txt", (&FileTarget{Path: "a.txt"}).Name())
+	assert.Equal(t, "file://a.txt", (&FileTarget{Path: "./a.txt"}).Name())
+	assert.Equal(t, "file://a.txt", (&FileTarget{Path: filepath.Join("b", "..", "a.txt")}).Name())
+	assert.Equal(t, "file://b/a.txt", (&FileTarget{Path: filepath.Join("b", ".", "a.txt")}).Name())
+	assert.Equal(t, "file://../a.txt", (&FileTarget{Path: filepath.Join("..", "a.txt")}).Name())
+	assert.Equal(t, "file:///b/a.txt", (&FileTarget{Path: "/b//c/../a.txt"}).Name())
+}
@@ -1,16 +1,25 @@
 package yamlfe
 
 import (
+	"fmt"
 	"github.com/tobiash/go-make/pkg/mk"
 	"gopkg.in/yaml.v3"
 	"io"
 	"regexp"
+	"strconv"
 	"text/template"
 )
 
 type Makefile struct {
-	Shell []string      `yaml:"shell"`
-	Rules []ruleWrapper `yaml:"rules"`
+	// Dir is the directory file targets are relative to
+	Dir string `yaml:"-"`
+	// Shell is the command line recipes are appended to, unless overridden by a rule. If neither
+	// is set, the executor's default shell is used.
+	Shell []string `yaml:"shell"`
+	// Pools are resource pools with the number of units they have, rules can limit how many of
+	// their recipes run at once by using units of them
+	Pools map[string]int `yaml:"pools"`
+	Rules []ruleWrapper  `yaml:"rules"`
 }
 
 // ruleWrapper is a helper for yaml unmarshalling that wraps different rule types
@@ -22,10 +31,40 @@ type rule interface {
 	build(f *Makefile) (mk.Rule, error)
 }
 
-type regexpRuleRaw struct {
-	Pattern       string   `yaml:"pattern"`
+// recipeRuleRaw holds the fields of all rules with a recipe
+type recipeRuleRaw struct {
 	Prerequisites []string `yaml:"prerequisites"`
-	Recipe        []string `yaml:"recipe"`
+	// OrderOnly are prerequisites which are made first, but do not make the target out of date
+	OrderOnly []string `yaml:"order_only"`
+	Recipe    []string `yaml:"recipe"`
+	Shell     []string `yaml:"shell"`
+	// Pool is a pool of the makefile the recipe uses one unit of
+	Pool string `yaml:"pool"`
+	// Pools are pools of the makefile with the number of units the recipe uses
+	Pools map[string]int `yaml:"pools"`
+}
+
+type regexpRuleRaw struct {
+	Pattern string `yaml:"pattern"`
+	// Schemes are the schemes of the targets the pattern is matched against, defaults to file
+	Schemes []string `yaml:"schemes"`
+	// Outputs are templates of all targets the recipe makes at once, rendered like prerequisites
+	Outputs       []string `yaml:"outputs"`
+	recipeRuleRaw `yaml:",inline"`
+}
+
+// explicitRuleRaw is a rule for a literal list of files, taking precedence over pattern rules
+type explicitRuleRaw struct {
+	Targets []string `yaml:"targets"`
+	// Grouped tells that the recipe makes all targets at once, instead of each one by itself
+	Grouped       bool `yaml:"grouped"`
+	recipeRuleRaw `yaml:",inline"`
+}
+
+// phonyRuleRaw is a rule for phony targets, which are not files and are made every time
+type phonyRuleRaw struct {
+	Targets       []string `yaml:"targets"`
+	recipeRuleRaw `yaml:",inline"`
 }
 
 func (f *Makefile) Parse(r io.Reader) error {
@@ -44,41 +83,171 @@ func (f *Makefile) BuildRules() ([]mk.Rule, error) {
 	return rs, nil
 }
 
-func (r *regexpRuleRaw) build(f *Makefile) (mk.Rule, error) {
-	mr, err := regexp.Compile(r.Pattern)
-	if err != nil {
-		return nil, err
-	}
-	rec := make([]*template.Template, len(r.Recipe))
-	for i, r := range r.Recipe {
-		rtpl, err := template.New("").Parse(r)
+func parseTemplates(texts []string) ([]*template.Template, error) {
+	tpls := make([]*template.Template, len(texts))
+	for i, text := range texts {
+		tpl, err := template.New("").Parse(text)
 		if err != nil {
 			return nil, err
 		}
-		rec[i] = rtpl
+		tpls[i] = tpl
 	}
-	ps := make([]*template.Template, len(r.Prerequisites))
-	for k, p := range r.Prerequisites {
-		ptpl, err := template.New("").Parse(p)
-		if err != nil {
-			return nil, err
+	return tpls, nil
+}
+
+func (r *recipeRuleRaw) build(f *Makefile) (recipeRule, error) {
+	rec, err := parseTemplates(r.Recipe)
+	if err != nil {
+		return recipeRule{}, err
+	}
+	ps, err := parseTemplates(r.Prerequisites)
+	if err != nil {
+		return recipeRule{}, err
+	}
+	oo, err := parseTemplates(r.OrderOnly)
+	if err != nil {
+		return recipeRule{}, err
+	}
+	pools := make(map[string]int, len(r.Pools)+1)
+	for name, units := range r.Pools {
+		pools[name] = units
+	}
+	if r.Pool != "" {
+		pools[r.Pool]++
+	}
+	for name, units := range pools {
+		if _, ok := f.Pools[name]; !ok {
+			return recipeRule{}, fmt.Errorf("rule uses undeclared pool '%s'", name)
+		}
+		if units <= 0 {
+			return recipeRule{}, fmt.Errorf("rule uses %d units of pool '%s', but needs to use at least one", units, name)
 		}
-		ps[k] = ptpl
 	}
-	return &regexRule{
+	return recipeRule{
 		mkfile:        f,
-		regexp:        mr,
 		prerequisites: ps,
+		orderOnly:     oo,
 		recipe:        rec,
+		shell:         r.Shell,
+		pools:         pools,
+	}, nil
+}
+
+func (r *regexpRuleRaw) build(f *Makefile) (mk.Rule, error) {
+	mr, err := regexp.Compile(r.Pattern)
+	if err != nil {
+		return nil, err
+	}
+	rr, err := r.recipeRuleRaw.build(f)
+	if err != nil {
+		return nil, err
+	}
+	if rr.outputs, err = parseTemplates(r.Outputs); err != nil {
+		return nil, err
+	}
+	schemes := map[string]bool{}
+	for _, s := range r.Schemes {
+		schemes[s] = true
+	}
+	if len(schemes) == 0 {
+		schemes["file"] = true
+	}
+	return &regexRule{
+		recipeRule: rr,
+		regexp:     mr,
+		schemes:    schemes,
+	}, nil
+}
+
+func (r *explicitRuleRaw) build(f *Makefile) (mk.Rule, error) {
+	if len(r.Targets) == 0 {
+		return nil, fmt.Errorf("explicit rule without targets")
+	}
+	rr, err := r.recipeRuleRaw.build(f)
+	if err != nil {
+		return nil, err
+	}
+	targets := make(map[string]bool, len(r.Targets))
+	for _, t := range r.Targets {
+		targets[(&mk.FileTarget{Path: t}).Name()] = true
+		if r.Grouped {
+			// a template rendering the literal name
+			rr.outputs = append(rr.outputs, template.Must(template.New("").Parse("{{ "+strconv.Quote(t)+" }}")))
+		}
+	}
+	return &explicitRule{
+		recipeRule: rr,
+		targets:    targets,
+	}, nil
+}
+
+func (r *phonyRuleRaw) build(f *Makefile) (mk.Rule, error) {
+	if len(r.Targets) == 0 {
+		return nil, fmt.Errorf("phony rule without targets")
+	}
+	rr, err := r.recipeRuleRaw.build(f)
+	if err != nil {
+		return nil, err
+	}
+	targets := make(map[string]bool, len(r.Targets))
+	for _, t := range r.Targets {
+		targets[(&mk.PhonyTarget{Label: t}).Name()] = true
+	}
+	return &explicitRule{
+		recipeRule: rr,
+		targets:    targets,
 	}, nil
 }
 
+// Phony tells whether a name is declared as a phony target by a rule
+func (f *Makefile) Phony(name string) bool {
+	for i := range f.Rules {
+		if r, ok := f.Rules[i].rule.(*phonyRuleRaw); ok {
+			for _, t := range r.Targets {
+				if t == name {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Target resolves a name as used in the makefile, e.g. on the command line or as a prerequisite,
+// to a phony target if declared as such, or else using mk.ParseTarget. File targets are relative
+// to the makefile's directory.
+func (f *Makefile) Target(name string) (mk.Target, error) {
+	if f.Phony(name) {
+		return &mk.PhonyTarget{Label: name}, nil
+	}
+	t, err := mk.ParseTarget(name)
+	if err != nil {
+		return nil, err
+	}
+	if ft, ok := t.(*mk.FileTarget); ok {
+		ft.Dir = f.Dir
+	}
+	return t, nil
+}
+
 func (r *ruleWrapper) UnmarshalYAML(value *yaml.Node) error {
 	fields := make(map[string]interface{})
 	if err := value.Decode(&fields); err != nil {
 		return err
 	}
 	switch fields["type"] {
+	case "phony":
+		var raw phonyRuleRaw
+		if err := value.Decode(&raw); err != nil {
+			return err
+		}
+		r.rule = &raw
+	case "explicit":
+		var raw explicitRuleRaw
+		if err := value.Decode(&raw); err != nil {
+			return err
+		}
+		r.rule = &raw
 	default:
 		var raw regexpRuleRaw
 		if err := value.Decode(&raw); err != nil {
@@ -2,6 +2,7 @@ package yamlfe
 
 import (
 	"context"
+	"errors"
 	"github.com/rs/zerolog/log"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -43,7 +44,7 @@ rules:
 	require.NoError(t, mkFile.Parse(strings.NewReader(mkFileYaml)))
 	rules, err := mkFile.BuildRules()
 	require.NoError(t, err)
-	assert.NoError(t, (&mk.Make{Rules: rules, Sum: &storage.Mem{}}).Make(se, ctx, &mk.FileTarget{Path: "a.foo"}))
+	assert.NoError(t, (&mk.Make{Rules: rules, Sum: &storage.Mem{}}).Make(se, ctx, &mk.FileTarget{Dir: d, Path: "a.foo"}))
 	assert.FileExists(t, filepath.Join(d, "a.foo"))
 	assert.FileExists(t, filepath.Join(d, "c.foo"))
 	assert.FileExists(t, filepath.Join(d, "b.foo"))
@@ -51,3 +52,247 @@ rules:
 	require.NoError(t, err)
 	assert.Equal(t, "b\nc\n", string(aContent))
 }
+
+func TestIntegrationShellOverride(t *testing.T) {
+	d, err := ioutil.TempDir("", "go-make")
+	require.NoError(t, err)
+	ctx := log.Logger.WithContext(context.TODO())
+	defer func() { _ = os.RemoveAll(d) }()
+	mkFileYaml := `
+shell: [ "/usr/bin/env", "bash", "-c" ]
+rules:
+- pattern: "a.txt"
+  recipe:
+  - "[[ -n bash ]] && echo \"a\" > {{ .Target.Path }}"
+- pattern: "b.txt"
+  shell: [ "/usr/bin/env", "sh", "-c" ]
+  recipe:
+  - "echo \"b\" > {{ .Target.Path }}"
+`
+	mkFile := &Makefile{}
+	require.NoError(t, mkFile.Parse(strings.NewReader(mkFileYaml)))
+	rules, err := mkFile.BuildRules()
+	require.NoError(t, err)
+	m := &mk.Make{Rules: rules, Sum: &storage.Mem{}}
+	assert.NoError(t, m.Make(&shell.ShellExecutor{Dir: d}, ctx, &mk.FileTarget{Dir: d, Path: "a.txt"}, &mk.FileTarget{Dir: d, Path: "b.txt"}))
+	assert.FileExists(t, filepath.Join(d, "a.txt"))
+	assert.FileExists(t, filepath.Join(d, "b.txt"))
+}
+
+func TestIntegrationExplicitRule(t *testing.T) {
+	d, err := ioutil.TempDir("", "go-make")
+	require.NoError(t, err)
+	ctx := log.Logger.WithContext(context.TODO())
+	defer func() { _ = os.RemoveAll(d) }()
+	mkFileYaml := `
+rules:
+- pattern: ".+\\.txt"
+  recipe:
+  - "echo generic > {{ .Target.Path }}"
+- type: explicit
+  targets: [ "special.txt" ]
+  recipe:
+  - "echo special > {{ .Target.Path }}"
+`
+	mkFile := &Makefile{}
+	require.NoError(t, mkFile.Parse(strings.NewReader(mkFileYaml)))
+	rules, err := mkFile.BuildRules()
+	require.NoError(t, err)
+	m := &mk.Make{Rules: rules, Sum: &storage.Mem{}}
+	assert.NoError(t, m.Make(&shell.ShellExecutor{Dir: d}, ctx, &mk.FileTarget{Dir: d, Path: "special.txt"}, &mk.FileTarget{Dir: d, Path: "other.txt"}))
+	content, err := ioutil.ReadFile(filepath.Join(d, "special.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "special\n", string(content))
+	content, err = ioutil.ReadFile(filepath.Join(d, "other.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "generic\n", string(content))
+}
+
+func TestIntegrationPhony(t *testing.T) {
+	d, err := ioutil.TempDir("", "go-make")
+	require.NoError(t, err)
+	ctx := log.Logger.WithContext(context.TODO())
+	defer func() { _ = os.RemoveAll(d) }()
+	mkFileYaml := `
+rules:
+- type: phony
+  targets: [ "all" ]
+  prerequisites: [ "a.txt", "check" ]
+  recipe:
+  - "echo all >> log.txt"
+- type: phony
+  targets: [ "check" ]
+  recipe:
+  - "echo {{ .Target.Label }} >> log.txt"
+- pattern: "a.txt"
+  recipe:
+  - "echo a >> log.txt; touch {{ .Target.Path }}"
+`
+	mkFile := &Makefile{Dir: d}
+	require.NoError(t, mkFile.Parse(strings.NewReader(mkFileYaml)))
+	rules, err := mkFile.BuildRules()
+	require.NoError(t, err)
+	all, err := mkFile.Target("all")
+	require.NoError(t, err)
+	assert.Equal(t, &mk.PhonyTarget{Label: "all"}, all)
+	a, err := mkFile.Target("a.txt")
+	require.NoError(t, err)
+	assert.Equal(t, &mk.FileTarget{Dir: d, Path: "a.txt"}, a)
+	m := &mk.Make{Rules: rules, Sum: &mk.YamlSumStorageFile{Path: filepath.Join(d, "go-make.sum")}, Jobs: 1}
+	se := &shell.ShellExecutor{Dir: d}
+	assert.NoError(t, m.Make(se, ctx, all))
+	assert.NoError(t, m.Make(se, ctx, all))
+	content, err := ioutil.ReadFile(filepath.Join(d, "log.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "a\ncheck\nall\ncheck\nall\n", string(content))
+
+	err = m.Make(se, ctx, &mk.PhonyTarget{Label: "undeclared"})
+	assert.True(t, errors.Is(err, mk.ErrNoRule))
+}
+
+func TestIntegrationMixedTargets(t *testing.T) {
+	d, err := ioutil.TempDir("", "go-make")
+	require.NoError(t, err)
+	ctx := log.Logger.WithContext(context.TODO())
+	defer func() { _ = os.RemoveAll(d) }()
+	mkFileYaml := `
+rules:
+- type: phony
+  targets: [ "all" ]
+  prerequisites: [ "phony:gen-a", "phony:gen-b" ]
+- pattern: "^phony:gen-(?P<name>.+)$"
+  schemes: [ "phony" ]
+  prerequisites: [ "{{ .Matches.name }}.txt" ]
+  recipe:
+  - "cp {{ (index .Prerequisites 0).Path }} {{ .Matches.name }}.out"
+- pattern: ".*"
+  recipe:
+  - "echo {{ .Target.Path }} > {{ .Target.Path }}"
+`
+	mkFile := &Makefile{Dir: d}
+	require.NoError(t, mkFile.Parse(strings.NewReader(mkFileYaml)))
+	rules, err := mkFile.BuildRules()
+	require.NoError(t, err)
+	m := &mk.Make{Rules: rules, Sum: &storage.Mem{}}
+	assert.NoError(t, m.Make(&shell.ShellExecutor{Dir: d}, ctx, &mk.PhonyTarget{Label: "all"}))
+	for _, name := range []string{"a", "b"} {
+		content, err := ioutil.ReadFile(filepath.Join(d, name+".out"))
+		require.NoError(t, err)
+		assert.Equal(t, name+".txt\n", string(content))
+	}
+}
+
+func TestIntegrationGroupedTargets(t *testing.T) {
+	d, err := ioutil.TempDir("", "go-make")
+	require.NoError(t, err)
+	ctx := log.Logger.WithContext(context.TODO())
+	defer func() { _ = os.RemoveAll(d) }()
+	mkFileYaml := `
+rules:
+- pattern: "(?P<base>[^/]+?)(_grpc)?\\.pb\\.go$"
+  outputs: [ "{{ .Matches.base }}.pb.go", "{{ .Matches.base }}_grpc.pb.go" ]
+  recipe:
+  - "echo pb >> count && touch {{ .Matches.base }}.pb.go {{ .Matches.base }}_grpc.pb.go"
+- type: explicit
+  grouped: true
+  targets: [ "x.h", "x.c" ]
+  recipe:
+  - "echo x >> count && touch x.h x.c"
+`
+	mkFile := &Makefile{Dir: d}
+	require.NoError(t, mkFile.Parse(strings.NewReader(mkFileYaml)))
+	rules, err := mkFile.BuildRules()
+	require.NoError(t, err)
+	m := &mk.Make{Rules: rules, Sum: &mk.YamlSumStorageFile{Path: filepath.Join(d, "go-make.sum")}, Jobs: 4}
+	var targets []mk.Target
+	for _, name := range []string{"foo.pb.go", "foo_grpc.pb.go", "x.h", "x.c"} {
+		target, err := mkFile.Target(name)
+		require.NoError(t, err)
+		targets = append(targets, target)
+	}
+	require.NoError(t, m.Make(&shell.ShellExecutor{Dir: d}, ctx, targets...))
+	content, err := ioutil.ReadFile(filepath.Join(d, "count"))
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"pb", "x"}, strings.Fields(string(content)))
+
+	require.NoError(t, m.Make(&shell.ShellExecutor{Dir: d}, ctx, targets...))
+	content, err = ioutil.ReadFile(filepath.Join(d, "count"))
+	require.NoError(t, err)
+	assert.Len(t, strings.Fields(string(content)), 2)
+}
+
+func TestIntegrationSharedPrerequisite(t *testing.T) {
+	d, err := ioutil.TempDir("", "go-make")
+	require.NoError(t, err)
+	ctx := log.Logger.WithContext(context.TODO())
+	defer func() { _ = os.RemoveAll(d) }()
+	mkFileYaml := `
+rules:
+- type: explicit
+  targets: [ "a.out" ]
+  prerequisites: [ "./gen/../gen.txt" ]
+  recipe:
+  - "cp gen.txt a.out"
+- type: explicit
+  targets: [ "b.out" ]
+  prerequisites: [ "gen.txt" ]
+  recipe:
+  - "cp gen.txt b.out"
+- type: explicit
+  targets: [ "./gen.txt" ]
+  recipe:
+  - "echo gen >> count && touch gen.txt"
+`
+	mkFile := &Makefile{Dir: d}
+	require.NoError(t, mkFile.Parse(strings.NewReader(mkFileYaml)))
+	rules, err := mkFile.BuildRules()
+	require.NoError(t, err)
+	m := &mk.Make{Rules: rules, Sum: &mk.YamlSumStorageFile{Path: filepath.Join(d, "go-make.sum")}, Jobs: 4}
+	var targets []mk.Target
+	for _, name := range []string{"a.out", "b.out"} {
+		target, err := mkFile.Target(name)
+		require.NoError(t, err)
+		targets = append(targets, target)
+	}
+	require.NoError(t, m.Make(&shell.ShellExecutor{Dir: d}, ctx, targets...))
+	content, err := ioutil.ReadFile(filepath.Join(d, "count"))
+	require.NoError(t, err)
+	assert.Equal(t, "gen\n", string(content))
+}
+
+func TestIntegrationOrderOnly(t *testing.T) {
+	d, err := ioutil.TempDir("", "go-make")
+	require.NoError(t, err)
+	ctx := log.Logger.WithContext(context.TODO())
+	defer func() { _ = os.RemoveAll(d) }()
+	mkFileYaml := `
+rules:
+- type: explicit
+  targets: [ "out/a.txt" ]
+  prerequisites: [ "src.txt" ]
+  order_only: [ "out" ]
+  recipe:
+  - "echo a >> count && cp src.txt out/a.txt"
+- type: explicit
+  targets: [ "out" ]
+  recipe:
+  - "echo out >> count-out && mkdir -p out"
+`
+	require.NoError(t, ioutil.WriteFile(filepath.Join(d, "src.txt"), []byte("src"), 0644))
+	mkFile := &Makefile{Dir: d}
+	require.NoError(t, mkFile.Parse(strings.NewReader(mkFileYaml)))
+	rules, err := mkFile.BuildRules()
+	require.NoError(t, err)
+	m := &mk.Make{Rules: rules, Sum: &mk.YamlSumStorageFile{Path: filepath.Join(d, "go-make.sum")}}
+	target, err := mkFile.Target("out/a.txt")
+	require.NoError(t, err)
+	require.NoError(t, m.Make(&shell.ShellExecutor{Dir: d}, ctx, target))
+	// writing out/a.txt changed the digest of the directory, which must not make it again
+	require.NoError(t, m.Make(&shell.ShellExecutor{Dir: d}, ctx, target))
+	content, err := ioutil.ReadFile(filepath.Join(d, "count"))
+	require.NoError(t, err)
+	assert.Equal(t, "a\n", string(content))
+	content, err = ioutil.ReadFile(filepath.Join(d, "count-out"))
+	require.NoError(t, err)
+	assert.Equal(t, "out\n", string(content))
+}
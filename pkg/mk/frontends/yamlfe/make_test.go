@@ -18,6 +18,7 @@ rules:
       - "bar"
     recipe:
       - "touch {{ .Target }}"
+    shell: [ "/usr/bin/env", "sh", "-c" ]
 `
 	var mkFile Makefile
 	require.NoError(t, yaml.NewDecoder(strings.NewReader(testYaml)).Decode(&mkFile))
@@ -28,4 +29,39 @@ rules:
 	assert.NotNil(t, rules)
 	require.Len(t, rules, 1)
 	assert.IsType(t, &regexRule{}, rules[0])
+	assert.Equal(t, []string{"/usr/bin/env", "sh", "-c"}, rules[0].(*regexRule).shell)
+}
+
+func TestParsePools(t *testing.T) {
+	testYaml := `
+pools:
+  link: 2
+  mem: 4
+rules:
+  - pattern: "\\.bin$"
+    recipe: [ "ld" ]
+    pool: link
+    pools:
+      mem: 3
+  - type: explicit
+    targets: [ "a" ]
+    recipe: [ "touch a" ]
+`
+	var mkFile Makefile
+	require.NoError(t, yaml.NewDecoder(strings.NewReader(testYaml)).Decode(&mkFile))
+	assert.Equal(t, map[string]int{"link": 2, "mem": 4}, mkFile.Pools)
+	rules, err := mkFile.BuildRules()
+	require.NoError(t, err)
+	require.Len(t, rules, 2)
+	assert.Equal(t, map[string]int{"link": 1, "mem": 3}, rules[0].(*regexRule).pools)
+	assert.Empty(t, rules[1].(*explicitRule).pools)
+
+	mkFile.Pools = map[string]int{"link": 2}
+	_, err = mkFile.BuildRules()
+	assert.EqualError(t, err, "rule uses undeclared pool 'mem'")
+
+	mkFile.Pools = map[string]int{"link": 2, "mem": 4}
+	mkFile.Rules[0].rule.(*regexpRuleRaw).Pools["mem"] = -1
+	_, err = mkFile.BuildRules()
+	assert.EqualError(t, err, "rule uses -1 units of pool 'mem', but needs to use at least one")
 }
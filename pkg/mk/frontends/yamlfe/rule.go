@@ -3,9 +3,14 @@ package yamlfe
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
 	"github.com/rs/zerolog"
 	"github.com/tobiash/go-make/pkg/mk"
 	"regexp"
+	"sort"
+	"strings"
 	"text/template"
 )
 
@@ -15,59 +20,146 @@ type tplContext struct {
 	Prerequisites []mk.Target
 }
 
-type regexRule struct {
+// recipeRule is what all rules with a recipe have in common
+type recipeRule struct {
 	mkfile        *Makefile
-	regexp        *regexp.Regexp
 	prerequisites []*template.Template
+	orderOnly     []*template.Template
 	recipe        []*template.Template
+	shell         []string
+	pools         map[string]int
+	// outputs are all targets an invocation makes if it makes more than the matched one
+	outputs []*template.Template
+}
+
+// regexRule matches the names of targets, e.g. file://dir/a.txt
+type regexRule struct {
+	recipeRule
+	regexp  *regexp.Regexp
+	schemes map[string]bool
+}
+
+// explicitRule matches a fixed set of targets, e.g. files or phony targets
+type explicitRule struct {
+	recipeRule
+	targets map[string]bool
+}
+
+// shellExecutor is the executor needed by invocations of yaml rules
+type shellExecutor interface {
+	Shell() []string
+	RunShellWith(ctx context.Context, shell []string, cmd string) error
 }
 
 type invocation struct {
-	rule    *regexRule
-	target  mk.Target
-	prereqs []mk.Target
-	matches map[string]string
+	rule      *recipeRule
+	target    mk.Target
+	prereqs   []mk.Target
+	orderOnly []mk.Target
+	outputs   []mk.Target
+	matches   map[string]string
 }
 
 func (i *invocation) Prerequisites() []mk.Target {
 	return i.prereqs
 }
 
+func (i *invocation) OrderOnly() []mk.Target {
+	return i.orderOnly
+}
+
+func (i *invocation) Outputs() []mk.Target {
+	if i.outputs == nil {
+		return []mk.Target{i.target}
+	}
+	return i.outputs
+}
+
+func (i *invocation) Pools() map[string]int {
+	return i.rule.pools
+}
+
+func (i *invocation) Describe() ([]string, error) {
+	return i.render()
+}
+
+func (i *invocation) Digest(exec mk.Executor) (string, error) {
+	cmds, err := i.render()
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if se, ok := exec.(shellExecutor); ok {
+		_, _ = fmt.Fprintf(h, "%q\n", i.shell(se))
+	}
+	for _, cmd := range cmds {
+		_, _ = fmt.Fprintf(h, "%q\n", cmd)
+	}
+	return fmt.Sprintf("r: %s", base64.StdEncoding.EncodeToString(h.Sum(nil))), nil
+}
+
 func (i *invocation) Execute(exec mk.Executor, ctx context.Context) error {
-	se, ok := exec.(interface {
-		RunShell(ctx context.Context, cmd string) error
-	})
+	se, ok := exec.(shellExecutor)
 	if !ok {
 		panic("rule needs shell execution")
 	}
 	log := zerolog.Ctx(ctx)
+	cmds, err := i.render()
+	if err != nil {
+		return err
+	}
+	shell := i.shell(se)
+	for _, cmd := range cmds {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.Info().Str("cmd", cmd).Msg("executing recipe")
+		if err := se.RunShellWith(ctx, shell, cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shell returns the shell of the rule, falling back to the makefile's and the executor's one
+func (i *invocation) shell(se shellExecutor) []string {
+	switch {
+	case len(i.rule.shell) > 0:
+		return i.rule.shell
+	case i.rule.mkfile != nil && len(i.rule.mkfile.Shell) > 0:
+		return i.rule.mkfile.Shell
+	}
+	return se.Shell()
+}
+
+// render expands the recipe templates of the rule for this invocation
+func (i *invocation) render() ([]string, error) {
 	tplCtx := &tplContext{
 		Target:        i.target,
 		Prerequisites: i.prereqs,
 		Matches:       i.matches,
 	}
+	cmds := make([]string, len(i.rule.recipe))
 	for k := range i.rule.recipe {
-		if ctx.Err() != nil {
-			return ctx.Err()
-		}
 		buf := new(bytes.Buffer)
-		if err := i.rule.recipe[k].Execute(buf, &tplCtx); err != nil {
-			return err
-		}
-		log.Info().Str("cmd", buf.String()).Msg("executing recipe")
-		if err := se.RunShell(ctx, buf.String()); err != nil {
-			return err
+		if err := i.rule.recipe[k].Execute(buf, tplCtx); err != nil {
+			return nil, err
 		}
+		cmds[k] = buf.String()
 	}
-	return nil
+	return cmds, nil
 }
 
 func (r *regexRule) Match(target mk.Target) (mk.MatchQuality, mk.Invocation, error) {
-	ft, ok := target.(*mk.FileTarget)
-	if !ok {
-		panic("rule only supports file targets")
+	name := target.Name()
+	var scheme string
+	if i := strings.IndexByte(name, ':'); i >= 0 {
+		scheme = name[:i]
 	}
-	match := r.regexp.FindStringSubmatch(target.Name())
+	if !r.schemes[scheme] {
+		return mk.NoMatch, nil, nil
+	}
+	match := r.regexp.FindStringSubmatch(name)
 	if match == nil {
 		return mk.NoMatch, nil, nil
 	}
@@ -77,22 +169,87 @@ func (r *regexRule) Match(target mk.Target) (mk.MatchQuality, mk.Invocation, err
 			submatches[n] = match[i]
 		}
 	}
+	inv, err := r.invoke(target, submatches)
+	return mk.MatchImplicit, inv, err
+}
+
+func (r *regexRule) String() string {
+	return "pattern " + r.regexp.String()
+}
+
+func (r *explicitRule) String() string {
+	targets := make([]string, 0, len(r.targets))
+	for t := range r.targets {
+		targets = append(targets, t)
+	}
+	sort.Strings(targets)
+	return "targets " + strings.Join(targets, ", ")
+}
+
+func (r *explicitRule) Match(target mk.Target) (mk.MatchQuality, mk.Invocation, error) {
+	if !r.targets[target.Name()] {
+		return mk.NoMatch, nil, nil
+	}
+	inv, err := r.invoke(target, map[string]string{})
+	return mk.MatchExplicit, inv, err
+}
+
+// invoke renders the prerequisites, order-only prerequisites and outputs of the rule for a matched target
+func (r *recipeRule) invoke(target mk.Target, matches map[string]string) (mk.Invocation, error) {
 	ctx := tplContext{
 		Target:  target,
-		Matches: submatches,
+		Matches: matches,
 	}
-	prereqs := make([]mk.Target, len(r.prerequisites))
-	for i, ps := range r.prerequisites {
-		buf := new(bytes.Buffer)
-		if err := ps.Execute(buf, ctx); err != nil {
-			return mk.MatchImplicit, nil, err
+	prereqs, err := r.targets(r.prerequisites, target, ctx)
+	if err != nil {
+		return nil, err
+	}
+	orderOnly, err := r.targets(r.orderOnly, target, ctx)
+	if err != nil {
+		return nil, err
+	}
+	var outputs []mk.Target
+	if len(r.outputs) > 0 {
+		if outputs, err = r.targets(r.outputs, target, ctx); err != nil {
+			return nil, err
+		}
+		found := false
+		for _, o := range outputs {
+			found = found || o.Name() == target.Name()
+		}
+		if !found {
+			outputs = append(outputs, target)
 		}
-		prereqs[i] = &mk.FileTarget{Dir: ft.Dir, Path: buf.String()}
 	}
-	return mk.MatchImplicit, &invocation{
-		rule:    r,
-		target:  target,
-		prereqs: prereqs,
-		matches: submatches,
+	return &invocation{
+		rule:      r,
+		target:    target,
+		prereqs:   prereqs,
+		orderOnly: orderOnly,
+		outputs:   outputs,
+		matches:   matches,
 	}, nil
 }
+
+// targets renders templates naming targets for an invocation making a target
+func (r *recipeRule) targets(tpls []*template.Template, target mk.Target, ctx tplContext) ([]mk.Target, error) {
+	targets := make([]mk.Target, len(tpls))
+	for i, tpl := range tpls {
+		buf := new(bytes.Buffer)
+		if err := tpl.Execute(buf, ctx); err != nil {
+			return nil, err
+		}
+		t, err := r.mkfile.Target(buf.String())
+		if err != nil {
+			return nil, err
+		}
+		targets[i] = t
+		if ft, ok := target.(*mk.FileTarget); ok {
+			// targets are relative to the same directory as the target
+			if tt, ok := targets[i].(*mk.FileTarget); ok {
+				tt.Dir = ft.Dir
+			}
+		}
+	}
+	return targets, nil
+}
@@ -4,6 +4,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/tobiash/go-make/pkg/mk"
+	"github.com/tobiash/go-make/pkg/mk/shell"
 	"gopkg.in/yaml.v3"
 	"strings"
 	"testing"
@@ -42,4 +43,51 @@ recipe:
 	assert.Equal(t, mk.MatchImplicit, q)
 	assert.Len(t, inv.Prerequisites(), 1)
 	assert.Equal(t, &mk.FileTarget{Path: "foo.json"}, inv.Prerequisites()[0])
+	cmds, err := inv.Describe()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"echo foo; touch foo/bla.yaml"}, cmds)
+}
+
+func TestInvocationDigest(t *testing.T) {
+	digest := func(recipe string, exec mk.Executor) string {
+		mkFile := &Makefile{}
+		require.NoError(t, mkFile.Parse(strings.NewReader(`
+rules:
+- pattern: "a.foo"
+  recipe:
+  - "`+recipe+`"
+`)))
+		rules, err := mkFile.BuildRules()
+		require.NoError(t, err)
+		_, inv, err := rules[0].Match(&mk.FileTarget{Path: "a.foo"})
+		require.NoError(t, err)
+		d, err := inv.Digest(exec)
+		require.NoError(t, err)
+		return d
+	}
+	d := digest("touch {{ .Target.Path }}", &shell.ShellExecutor{})
+	assert.Equal(t, d, digest("touch a.foo", &shell.ShellExecutor{}))
+	assert.NotEqual(t, d, digest("touch {{ .Target.Path }} ", &shell.ShellExecutor{}))
+	assert.NotEqual(t, d, digest("touch {{ .Target.Path }}", &shell.ShellExecutor{ShellCmd: []string{"bash", "-c"}}))
+}
+
+func TestRulePrerequisiteTypes(t *testing.T) {
+	testYaml := `
+pattern: "a.txt"
+prerequisites:
+- "b.txt"
+- "file:c.txt"
+- "phony:lint"
+`
+	var r ruleWrapper
+	require.NoError(t, yaml.NewDecoder(strings.NewReader(testYaml)).Decode(&r))
+	rule, err := r.build(&Makefile{Dir: "dir"})
+	require.NoError(t, err)
+	_, inv, err := rule.Match(&mk.FileTarget{Dir: "dir", Path: "a.txt"})
+	require.NoError(t, err)
+	assert.Equal(t, []mk.Target{
+		&mk.FileTarget{Dir: "dir", Path: "b.txt"},
+		&mk.FileTarget{Dir: "dir", Path: "c.txt"},
+		&mk.PhonyTarget{Label: "lint"},
+	}, inv.Prerequisites())
 }
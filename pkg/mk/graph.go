@@ -0,0 +1,130 @@
+package mk
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/rs/zerolog"
+	"golang.org/x/mod/sumdb/storage"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// NodeInfo describes a target of an exported graph
+type NodeInfo struct {
+	Name string `json:"name"`
+	// Rule describes the rule making the target, empty if there is none
+	Rule     string `json:"rule,omitempty"`
+	UpToDate bool   `json:"upToDate"`
+}
+
+type graphEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type graphJSON struct {
+	Nodes []NodeInfo  `json:"nodes"`
+	Edges []graphEdge `json:"edges"`
+}
+
+// Graph computes the DAG for making the targets and checks which of them would be made, as in
+// question mode. The returned map describes every target of the DAG by name.
+func (m *Make) Graph(executor Executor, ctx context.Context, targets ...Target) (*DAG, map[string]NodeInfo, error) {
+	dag, rules, orderOnly, err := m.dag(zerolog.Ctx(ctx), targets...)
+	if err != nil {
+		return nil, nil, err
+	}
+	question := *m
+	question.Question, question.DryRun = true, false
+	var b *build
+	if err := m.Sum.ReadOnly(ctx, func(ctx context.Context, sumTr storage.Transaction) error {
+		b = &build{Make: &question, executor: executor, sumTr: sumTr, rules: rules, orderOnly: orderOnly}
+		return dag.WalkUp(ctx, m.jobs(), b.make)
+	}); err != nil {
+		return nil, nil, err
+	}
+	nodes := make(map[string]NodeInfo, len(dag.graph))
+	for t := range dag.graph {
+		info := NodeInfo{Name: t.Name(), UpToDate: !b.remade[t.Name()]}
+		if _, ok := rules[t.Name()]; ok {
+			rule, _, err := m.ruleFor(t)
+			if err != nil {
+				return nil, nil, err
+			}
+			info.Rule = describeRule(rule)
+		}
+		nodes[t.Name()] = info
+	}
+	return dag, nodes, nil
+}
+
+// describeRule returns a description of a rule for humans
+func describeRule(r Rule) string {
+	if s, ok := r.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprintf("%T", r)
+}
+
+// export lists the nodes and edges of the graph in a stable order, describing nodes using the given
+// map and by their name if they are missing from it
+func (g *DAG) export(nodes map[string]NodeInfo) graphJSON {
+	var export graphJSON
+	for t, prereqs := range g.graph {
+		info, ok := nodes[t.Name()]
+		if !ok {
+			info = NodeInfo{Name: t.Name()}
+		}
+		export.Nodes = append(export.Nodes, info)
+		for p := range prereqs {
+			export.Edges = append(export.Edges, graphEdge{From: t.Name(), To: p.Name()})
+		}
+	}
+	sort.Slice(export.Nodes, func(i, j int) bool { return export.Nodes[i].Name < export.Nodes[j].Name })
+	sort.Slice(export.Edges, func(i, j int) bool {
+		if export.Edges[i].From != export.Edges[j].From {
+			return export.Edges[i].From < export.Edges[j].From
+		}
+		return export.Edges[i].To < export.Edges[j].To
+	})
+	return export
+}
+
+// WriteDOT writes the graph in the Graphviz DOT format, with edges from targets to their
+// prerequisites. Nodes are described using the given map, out-of-date targets are highlighted.
+func (g *DAG) WriteDOT(w io.Writer, nodes map[string]NodeInfo) error {
+	export := g.export(nodes)
+	if _, err := fmt.Fprintln(w, "digraph \"go-make\" {"); err != nil {
+		return err
+	}
+	for _, n := range export.Nodes {
+		label := n.Name
+		if n.Rule != "" {
+			label += "\n" + n.Rule
+		}
+		attrs := fmt.Sprintf("label=%s", strconv.Quote(label))
+		if _, ok := nodes[n.Name]; ok && !n.UpToDate {
+			attrs += ", style=filled, fillcolor=\"#f4cccc\""
+		}
+		if _, err := fmt.Fprintf(w, "  %s [%s];\n", strconv.Quote(n.Name), attrs); err != nil {
+			return err
+		}
+	}
+	for _, e := range export.Edges {
+		if _, err := fmt.Fprintf(w, "  %s -> %s;\n", strconv.Quote(e.From), strconv.Quote(e.To)); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintln(w, "}")
+	return err
+}
+
+// WriteJSON writes the graph as JSON object with a list of nodes, described using the given map,
+// and a list of edges from targets to their prerequisites
+func (g *DAG) WriteJSON(w io.Writer, nodes map[string]NodeInfo) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(g.export(nodes))
+}
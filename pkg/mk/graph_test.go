@@ -0,0 +1,48 @@
+package mk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestGraph(t *testing.T) {
+	fs := newTestFS(map[string]string{"d": "d"})
+	m := &Make{
+		Sum:   testSum(t),
+		Rules: []Rule{&testRule{fs: fs, prereqs: map[string][]string{"a": {"b"}, "b": {"d"}}}},
+	}
+	// make b only, so a is the only out-of-date target
+	require.NoError(t, m.Make(nil, context.TODO(), &testTarget{"b", fs}))
+	assert.Equal(t, []string{"b"}, fs.madeTargets())
+
+	dag, nodes, err := m.Graph(nil, context.TODO(), &testTarget{"a", fs})
+	require.NoError(t, err)
+	assert.Empty(t, fs.madeTargets())
+	assert.Equal(t, map[string]NodeInfo{
+		"a": {Name: "a", Rule: "*mk.testRule", UpToDate: false},
+		"b": {Name: "b", Rule: "*mk.testRule", UpToDate: true},
+		"d": {Name: "d", UpToDate: true},
+	}, nodes)
+
+	var out bytes.Buffer
+	require.NoError(t, dag.WriteJSON(&out, nodes))
+	var export graphJSON
+	require.NoError(t, json.Unmarshal(out.Bytes(), &export))
+	assert.Equal(t, []graphEdge{{From: "a", To: "b"}, {From: "b", To: "d"}}, export.Edges)
+	assert.Len(t, export.Nodes, 3)
+
+	out.Reset()
+	require.NoError(t, dag.WriteDOT(&out, nodes))
+	assert.Equal(t, `digraph "go-make" {
+  "a" [label="a\n*mk.testRule", style=filled, fillcolor="#f4cccc"];
+  "b" [label="b\n*mk.testRule"];
+  "d" [label="d"];
+  "a" -> "b";
+  "b" -> "d";
+}
+`, out.String())
+}
@@ -0,0 +1,26 @@
+//go:build !windows
+// +build !windows
+
+package mk
+
+import (
+	"os"
+	"syscall"
+)
+
+// tryLockFile tries to acquire an advisory lock on a file without blocking
+func tryLockFile(f *os.File, exclusive bool) (bool, error) {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func unlockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
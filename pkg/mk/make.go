@@ -6,19 +6,42 @@ import (
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
 	"golang.org/x/mod/sumdb/storage"
+	"io"
+	"os"
 	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
+// MatchQuality tells how well a rule matches a target, the rule with the best match is used
 type MatchQuality int
 
 const (
 	NoMatch MatchQuality = iota
-	MatchExplicit
+	// MatchImplicit is a match of a generic rule, e.g. a pattern
 	MatchImplicit
+	// MatchExplicit is a match of a rule naming the target, taking precedence over implicit ones
+	MatchExplicit
 )
 
 var ErrTargetNotExists = fmt.Errorf("target does not exist")
 var ErrNoRule = fmt.Errorf("no rule to make target")
+var ErrGroupConflict = fmt.Errorf("first output of group is not made by the same group")
+
+// OutOfDateError is returned in question mode if any targets need to be made
+type OutOfDateError struct {
+	Targets []Target
+}
+
+func (e *OutOfDateError) Error() string {
+	names := make([]string, len(e.Targets))
+	for i := range e.Targets {
+		names[i] = e.Targets[i].Name()
+	}
+	return fmt.Sprintf("targets out of date: %s", strings.Join(names, ", "))
+}
 
 type Rule interface {
 	// Match checks if the rule matches the target and with which prerequisites
@@ -27,16 +50,93 @@ type Rule interface {
 
 type Invocation interface {
 	Prerequisites() []Target
+	// Describe renders what Execute would do as human-readable lines, without doing it
+	Describe() ([]string, error)
+	// Digest summarizes what Execute would do with the given executor, e.g. the rendered recipe and
+	// the shell running it. Targets are made again when the digest of their invocation changes.
+	Digest(exec Executor) (string, error)
 	Execute(exec Executor, ctx context.Context) error
 }
 
 type Executor interface {
 }
 
+// GroupedInvocation is implemented by invocations making several targets at once, e.g. a code
+// generator writing several files. All outputs are made by executing the invocation of the first
+// one by name a single time, and are recorded together.
+type GroupedInvocation interface {
+	// Outputs returns all targets made by the invocation, including the one it was matched for
+	Outputs() []Target
+}
+
+// groupOutputs returns the outputs of a grouped invocation ordered by name
+func groupOutputs(inv GroupedInvocation) []Target {
+	outputs := append([]Target{}, inv.Outputs()...)
+	sort.Slice(outputs, func(i, j int) bool { return outputs[i].Name() < outputs[j].Name() })
+	return outputs
+}
+
+// OrderOnlyInvocation is implemented by invocations with order-only prerequisites, which are made
+// before the invocation is executed like its other prerequisites, but whose changes do not make the
+// target out of date, e.g. a directory the target is written to. Targets that are only order-only
+// prerequisites are up-to-date whenever they exist.
+type OrderOnlyInvocation interface {
+	OrderOnly() []Target
+}
+
+// sameGroup tells whether an invocation is grouped with the given outputs, ordered by name
+func sameGroup(inv Invocation, outputs []Target) bool {
+	gi, ok := inv.(GroupedInvocation)
+	if !ok {
+		return false
+	}
+	other := groupOutputs(gi)
+	if len(other) != len(outputs) {
+		return false
+	}
+	for i := range other {
+		if other[i].Name() != outputs[i].Name() {
+			return false
+		}
+	}
+	return true
+}
+
+// ScopedExecutor is implemented by executors which need to know the target an invocation makes,
+// e.g. to capture its output
+type ScopedExecutor interface {
+	// Scope returns the executor to make the target with, and a function to be called with the
+	// error of the invocation, returning the error to report
+	Scope(target Target) (Executor, func(error) error)
+}
+
+// Make makes targets using rules. Besides the sum storage and rules, the exported fields are options
+// controlling how targets are made.
 type Make struct {
-	Sum      storage.Storage
-	Rules    []Rule
-	nWorkers int
+	Sum   storage.Storage
+	Rules []Rule
+	// Jobs is the number of targets made in parallel, defaults to the number of CPUs
+	Jobs int
+	// KeepGoing continues making every target not depending on a failed one, see DAG.Mode
+	KeepGoing bool
+	// DryRun prints the recipes of out-of-date targets to Out in dependency order instead of
+	// executing them
+	DryRun bool
+	// Question only checks the targets and returns an *OutOfDateError if any of them would be made
+	Question bool
+	// AlwaysMake makes every target with a rule, even if it is up-to-date
+	AlwaysMake bool
+	// Explain, if set, is called with the reason for every target that is made or, in question and
+	// dry-run mode, would be made. Calls are serialized.
+	Explain func(target Target, reason Reason)
+	// Events, if set, receives the events of the build
+	Events EventSink
+	// Pools are the resource pools invocations can use units of by name, with the number of units
+	// each one has. Targets are only made while the units they need are free, see PooledInvocation
+	// and DAG.Units.
+	Pools map[string]int
+	// Out receives the output of Make itself, defaults to os.Stdout
+	Out io.Writer
 }
 
 type TargetStatus struct {
@@ -57,80 +157,460 @@ type Target interface {
 
 // Make makes a target
 func (m *Make) Make(executor Executor, ctx context.Context, targets ...Target) error {
-	dag, rules, err := m.dag(zerolog.Ctx(ctx), targets...)
+	dag, rules, orderOnly, err := m.dag(zerolog.Ctx(ctx), targets...)
 	if err != nil {
 		return err
 	}
-	nWorkers := m.nWorkers
-	if nWorkers == 0 {
-		nWorkers = runtime.NumCPU()
+	if m.KeepGoing {
+		dag.Mode = KeepGoing
+	}
+	dag.Events = m.Events
+	emit(m.Events, Event{Kind: EventGraphComputed, Worker: -1, Targets: len(dag.graph)})
+	dag.Pools, dag.Units = m.Pools, poolUnits(rules)
+	nWorkers := m.jobs()
+	// transactions may be retried, so every attempt starts from a fresh build
+	var b *build
+	run := func(ctx context.Context, sumTr storage.Transaction) error {
+		b = &build{Make: m, executor: executor, sumTr: sumTr, rules: rules, orderOnly: orderOnly}
+		dag.Cost = b.cost(ctx)
+		return dag.WalkUp(ctx, nWorkers, b.make)
 	}
-	return m.Sum.ReadWrite(ctx, func(ctx context.Context, sumTr storage.Transaction) error {
-		return dag.WalkUp(ctx, nWorkers, func(ctx context.Context, target Target) error {
-			log := zerolog.Ctx(ctx).With().Str("target", target.Name()).Logger()
-			digest, err := sumTr.ReadValue(ctx, target.Name())
-			if err != nil {
-				return errors.Wrapf(err, "error checking previous digest of target '%s'", target.Name())
+	switch {
+	case m.Question:
+		if err := m.Sum.ReadOnly(ctx, run); err != nil {
+			return err
+		}
+		if len(b.outOfDate) > 0 {
+			sort.Slice(b.outOfDate, func(i, j int) bool { return b.outOfDate[i].Name() < b.outOfDate[j].Name() })
+			return &OutOfDateError{Targets: b.outOfDate}
+		}
+		return nil
+	case m.DryRun:
+		if err := m.Sum.ReadOnly(ctx, run); err != nil {
+			return err
+		}
+		out := m.Out
+		if out == nil {
+			out = os.Stdout
+		}
+		for _, l := range b.recipes {
+			if _, err := fmt.Fprintln(out, l); err != nil {
+				return err
 			}
-			status, err := target.Check(digest)
-			if err != nil {
-				return errors.Wrapf(err, "error checking status of target '%s'", target.Name())
+		}
+		return nil
+	}
+	return m.Sum.ReadWrite(ctx, run)
+}
+
+// poolUnits returns the units of pools needed to make targets, which the DAG hands out to workers
+// only while they are free. Outputs of a group besides the first one are made along with it.
+func poolUnits(rules map[string]Invocation) func(Target) map[string]int {
+	return func(target Target) map[string]int {
+		inv := rules[target.Name()]
+		if gi, ok := inv.(GroupedInvocation); ok && groupOutputs(gi)[0].Name() != target.Name() {
+			return nil
+		}
+		if pi, ok := inv.(PooledInvocation); ok {
+			return pi.Pools()
+		}
+		return nil
+	}
+}
+
+func (m *Make) jobs() int {
+	if m.Jobs == 0 {
+		return runtime.NumCPU()
+	}
+	return m.Jobs
+}
+
+// build is the state of a single Make invocation
+type build struct {
+	*Make
+	executor Executor
+	sumTr    storage.Transaction
+	rules    map[string]Invocation
+	// orderOnly are the targets that are only order-only prerequisites
+	orderOnly map[string]bool
+
+	lock      sync.Mutex
+	digests   map[string]string
+	remade    map[string]bool
+	outOfDate []Target
+	recipes   []string
+}
+
+// cost returns the duration it took to make a target the last time, as recorded in the sum storage
+func (b *build) cost(ctx context.Context) func(Target) time.Duration {
+	return func(target Target) time.Duration {
+		// the duration only guides the scheduling, so errors are left for make to report
+		value, err := b.sumTr.ReadValue(ctx, target.Name())
+		if err != nil {
+			return 0
+		}
+		rec, err := parseRecord(value)
+		if err != nil {
+			return 0
+		}
+		return rec.Duration
+	}
+}
+
+// make makes a single target, once all its prerequisites have been made. The outputs of a grouped
+// invocation are all made along with the first one, see GroupedInvocation.
+func (b *build) make(ctx context.Context, target Target) error {
+	log := zerolog.Ctx(ctx).With().Str("target", target.Name()).Logger()
+	rule, ruleExists := b.rules[target.Name()]
+	if !ruleExists {
+		_, _, status, err := b.read(ctx, target)
+		if err != nil {
+			return err
+		}
+		if !status.Exists {
+			return errors.Wrapf(ErrNoRule, "error making target '%s'", target.Name())
+		}
+		log.Debug().Msg("target has no rule")
+		emit(b.Events, Event{Kind: EventUpToDate, Target: target, Worker: WorkerID(ctx)})
+		b.done(target, status.CurrentDigest, false)
+		return nil
+	}
+	outputs := []Target{target}
+	if gi, ok := rule.(GroupedInvocation); ok {
+		outputs = groupOutputs(gi)
+		if outputs[0].Name() != target.Name() {
+			return b.groupOutput(ctx, target, outputs[0])
+		}
+	}
+
+	recipe, err := rule.Digest(b.executor)
+	if err != nil {
+		return errors.Wrapf(err, "error computing recipe digest of target '%s'", target.Name())
+	}
+	states := make([]*targetState, len(outputs))
+	var reason Reason
+	stale := false
+	for i, o := range outputs {
+		if states[i], err = b.assess(ctx, o, rule, recipe); err != nil {
+			return err
+		}
+		if states[i].stale && !stale {
+			reason, stale = states[i].reason, true
+		}
+	}
+	if !stale {
+		log.Debug().Msg("target is up-to-date")
+		emit(b.Events, Event{Kind: EventUpToDate, Target: target, Worker: WorkerID(ctx)})
+		for _, st := range states {
+			b.done(st.target, st.status.CurrentDigest, false)
+			if err := b.record(st.target, st.value, record{Digest: st.status.CurrentDigest, Prerequisites: st.prereqs, Recipe: recipe, Duration: st.rec.Duration}); err != nil {
+				return err
 			}
-			rule, ruleExists := rules[target]
-			switch {
-			case !ruleExists && !status.Exists:
-				return errors.Wrapf(ErrNoRule, "error making target '%s'", target.Name())
-			case status.UpToDate:
-				log.Debug().Msg("target is up-to-date")
-			default:
-				if err := rule.Execute(executor, ctx); err != nil {
-					return err
-				}
-				status, err = target.Check(digest)
-				if err != nil {
-					return errors.Wrapf(err, "error checking status of target '%s' post-exec", target.Name())
-				}
-				if err = sumTr.BufferWrites([]storage.Write{{
-					Key:   target.Name(),
-					Value: status.CurrentDigest,
-				}}); err != nil {
-					return err
-				}
+		}
+		return nil
+	}
+	log.Debug().Stringer("reason", reason).Msg("target is out of date")
+	if b.Explain != nil {
+		for _, st := range states {
+			if st.stale {
+				b.explain(st.target, st.reason)
 			}
-			return nil
-		})
-	})
+		}
+	}
+	switch {
+	case b.Question:
+		for _, st := range states {
+			b.done(st.target, st.status.CurrentDigest, true)
+		}
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		b.outOfDate = append(b.outOfDate, outputs...)
+		return nil
+	case b.DryRun:
+		for _, st := range states {
+			b.done(st.target, st.status.CurrentDigest, true)
+		}
+		return b.describe(target, rule)
+	}
+	exec, finish := b.executor, func(err error) error { return err }
+	if se, ok := b.executor.(ScopedExecutor); ok {
+		exec, finish = se.Scope(target)
+	}
+	emit(b.Events, Event{Kind: EventExecuting, Target: target, Worker: WorkerID(ctx), Reason: reason})
+	started := time.Now()
+	err = finish(rule.Execute(exec, ctx))
+	duration := time.Since(started)
+	if err != nil {
+		return err
+	}
+	for _, st := range states {
+		status, err := st.target.Check(st.rec.Digest)
+		if err != nil {
+			return errors.Wrapf(err, "error checking status of target '%s' post-exec", st.target.Name())
+		}
+		b.done(st.target, status.CurrentDigest, true)
+		if !status.Exists {
+			// nothing to record, e.g. for phony targets
+			continue
+		}
+		if err := b.record(st.target, st.value, record{Digest: status.CurrentDigest, Prerequisites: st.prereqs, Recipe: recipe, Duration: duration}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// groupOutput completes an output of a group besides the first one, which was made or found
+// up-to-date along with the first one
+func (b *build) groupOutput(ctx context.Context, target, first Target) error {
+	b.lock.Lock()
+	remade, ok := b.remade[first.Name()]
+	b.lock.Unlock()
+	if !ok {
+		return errors.Wrapf(ErrGroupConflict, "error making target '%s' with its group", target.Name())
+	}
+	status, err := target.Check("")
+	if err != nil {
+		return errors.Wrapf(err, "error checking status of target '%s'", target.Name())
+	}
+	zerolog.Ctx(ctx).Debug().Str("target", target.Name()).Str("group", first.Name()).Bool("remade", remade).Msg("target was made with its group")
+	if !remade {
+		emit(b.Events, Event{Kind: EventUpToDate, Target: target, Worker: WorkerID(ctx)})
+	}
+	b.done(target, status.CurrentDigest, remade)
+	return nil
+}
+
+// targetState is what make finds out about a target with a rule before making it
+type targetState struct {
+	target  Target
+	value   string
+	rec     record
+	status  TargetStatus
+	prereqs map[string]string
+	reason  Reason
+	stale   bool
+}
+
+// read reads the record of a target and checks its status against it
+func (b *build) read(ctx context.Context, target Target) (string, record, TargetStatus, error) {
+	value, err := b.sumTr.ReadValue(ctx, target.Name())
+	if err != nil {
+		return "", record{}, TargetStatus{}, errors.Wrapf(err, "error checking previous digest of target '%s'", target.Name())
+	}
+	rec, err := parseRecord(value)
+	if err != nil {
+		return "", record{}, TargetStatus{}, errors.Wrapf(err, "error parsing previous record of target '%s'", target.Name())
+	}
+	status, err := target.Check(rec.Digest)
+	if err != nil {
+		return "", record{}, TargetStatus{}, errors.Wrapf(err, "error checking status of target '%s'", target.Name())
+	}
+	return value, rec, status, nil
+}
+
+// assess checks whether a target made by an invocation with the given recipe digest is stale
+func (b *build) assess(ctx context.Context, target Target, inv Invocation, recipe string) (*targetState, error) {
+	value, rec, status, err := b.read(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	prereqs, changed := b.prerequisites(value != "", rec, inv)
+	// records without a recipe digest are taken over as they are
+	recipeChanged := rec.Recipe != "" && rec.Recipe != recipe
+	reason, stale := b.staleness(value != "", rec, status, changed, recipeChanged, b.orderOnly[target.Name()])
+	return &targetState{
+		target:  target,
+		value:   value,
+		rec:     rec,
+		status:  status,
+		prereqs: prereqs,
+		reason:  reason,
+		stale:   stale,
+	}, nil
 }
 
-// dag computes the DAG for the given targets
-func (m *Make) dag(log *zerolog.Logger, targets ...Target) (*DAG, map[Target]Invocation, error) {
+// prerequisites collects the current digests of the prerequisites of an invocation and returns the
+// name of one that changed since the target was made, if any
+func (b *build) prerequisites(recorded bool, rec record, inv Invocation) (map[string]string, string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	digests := make(map[string]string)
+	var changed, remade string
+	for _, p := range inv.Prerequisites() {
+		name := p.Name()
+		digests[name] = b.digests[name]
+		if !b.remade[name] {
+			continue
+		}
+		remade = name
+		// remade prerequisites can only be compared if they were actually made and have a digest
+		if b.Question || b.DryRun || digests[name] == "" {
+			changed = name
+		}
+	}
+	switch {
+	case changed != "":
+		return digests, changed
+	case !recorded:
+		// without a previous record, only a remade prerequisite tells that the target is stale
+		return digests, remade
+	}
+	return digests, rec.changedPrerequisite(digests)
+}
+
+// staleness returns why a target has to be made, or false if it is up-to-date
+func (b *build) staleness(recorded bool, rec record, status TargetStatus, changed string, recipeChanged, orderOnly bool) (Reason, bool) {
+	switch {
+	case !status.UpToDate && !status.Exists && !recorded:
+		return Reason{Kind: ReasonNoRecord}, true
+	case !status.UpToDate && !status.Exists:
+		return Reason{Kind: ReasonMissing}, true
+	case orderOnly && status.Exists && !b.AlwaysMake:
+		// order-only prerequisites only have to exist, e.g. output directories whose digest
+		// changes whenever a target is written into them
+		return Reason{}, false
+	case !status.UpToDate:
+		return Reason{Kind: ReasonDigestMismatch, OldDigest: rec.Digest, NewDigest: status.CurrentDigest}, true
+	case changed != "":
+		return Reason{Kind: ReasonPrerequisiteChanged, Prerequisite: changed}, true
+	case recipeChanged:
+		return Reason{Kind: ReasonRecipeChanged}, true
+	case b.AlwaysMake:
+		return Reason{Kind: ReasonForced}, true
+	}
+	return Reason{}, false
+}
+
+// explain passes the reason for making a target to Make.Explain, one call at a time
+func (b *build) explain(target Target, reason Reason) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.Explain(target, reason)
+}
+
+// done records the digest of a target for the targets depending on it
+func (b *build) done(target Target, digest string, remade bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.digests == nil {
+		b.digests = make(map[string]string)
+		b.remade = make(map[string]bool)
+	}
+	b.digests[target.Name()] = digest
+	b.remade[target.Name()] = remade
+}
+
+// record stores the record of a target unless it is unchanged or Make is not supposed to write
+func (b *build) record(target Target, value string, rec record) error {
+	if b.Question || b.DryRun || rec.String() == value {
+		return nil
+	}
+	return b.sumTr.BufferWrites([]storage.Write{{
+		Key:   target.Name(),
+		Value: rec.String(),
+	}})
+}
+
+// describe records what an invocation would do instead of executing it
+func (b *build) describe(target Target, inv Invocation) error {
+	lines, err := inv.Describe()
+	if err != nil {
+		return errors.Wrapf(err, "error describing recipe of target '%s'", target.Name())
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.recipes = append(b.recipes, lines...)
+	return nil
+}
+
+// dag computes the DAG for the given targets, along with the targets that are only order-only
+// prerequisites and so only have to exist
+func (m *Make) dag(log *zerolog.Logger, targets ...Target) (*DAG, map[string]Invocation, map[string]bool, error) {
 	dag := NewDAG()
 	dag.Logger = log
+	// rules create new target values for prerequisites, so targets are deduplicated by name
+	// to make sure each one is visited once and cycles end up in the graph as such
+	known := make(map[string]Target)
+	canonical := func(t Target) (Target, bool) {
+		if c, ok := known[t.Name()]; ok {
+			return c, true
+		}
+		known[t.Name()] = t
+		return t, false
+	}
 	next := make([]Target, 0, len(targets))
-	next = append(next, targets...)
-	rules := make(map[Target]Invocation)
+	needed := make(map[string]bool)
+	for _, t := range targets {
+		if c, seen := canonical(t); !seen {
+			next = append(next, c)
+		}
+		needed[t.Name()] = true
+	}
+	rules := make(map[string]Invocation)
+	orderOnly := make(map[string]bool)
 
 	for len(next) > 0 {
 		u := next[0]
 		next = next[1:]
 		r, inv, err := m.ruleFor(u)
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, nil, err
 		}
 		if r != nil {
-			rules[u] = inv
-			prereq := inv.Prerequisites()
-			for p := range prereq {
-				if _, ok := rules[prereq[p]]; !ok {
-					next = append(next, prereq[p])
+			rules[u.Name()] = inv
+			if gi, ok := inv.(GroupedInvocation); ok {
+				// outputs of a group besides the first one are made along with it, which must be
+				// matched by the same group to do so
+				outputs := groupOutputs(gi)
+				if first := outputs[0]; first.Name() != u.Name() {
+					_, leader, err := m.ruleFor(first)
+					if err != nil {
+						return nil, nil, nil, err
+					}
+					if !sameGroup(leader, outputs) {
+						return nil, nil, nil, errors.Wrapf(ErrGroupConflict, "error adding group of target '%s' with first output '%s'", u.Name(), first.Name())
+					}
+					c, seen := canonical(first)
+					if !seen {
+						next = append(next, c)
+					}
+					needed[c.Name()] = true
+					if err := dag.AddTarget(u, []Target{c}); err != nil {
+						return nil, nil, nil, errors.Wrapf(err, "error adding group of target '%s'", u.Name())
+					}
+					continue
+				}
+			}
+			prereqs := inv.Prerequisites()
+			for _, t := range prereqs {
+				needed[t.Name()] = true
+			}
+			if oi, ok := inv.(OrderOnlyInvocation); ok {
+				for _, t := range oi.OrderOnly() {
+					orderOnly[t.Name()] = true
 				}
+				prereqs = append(append([]Target{}, prereqs...), oi.OrderOnly()...)
 			}
-			dag.AddTarget(u, prereq)
-		} else {
-			dag.AddTarget(u, nil)
+			prereq := make([]Target, len(prereqs))
+			for p, t := range prereqs {
+				c, seen := canonical(t)
+				if !seen {
+					next = append(next, c)
+				}
+				prereq[p] = c
+			}
+			if err := dag.AddTarget(u, prereq); err != nil {
+				return nil, nil, nil, errors.Wrapf(err, "error adding prerequisites of target '%s'", u.Name())
+			}
+		} else if err := dag.AddTarget(u, nil); err != nil {
+			return nil, nil, nil, err
 		}
 	}
-	return dag, rules, nil
+	for name := range needed {
+		delete(orderOnly, name)
+	}
+	return dag, rules, orderOnly, nil
 }
 
 // rileFor searches for the first rule that "best" matches a target
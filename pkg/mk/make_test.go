@@ -1,7 +1,628 @@
 package mk
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/mod/sumdb/storage"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testFS is an in-memory file system of target contents, recording which targets were made
+type testFS struct {
+	lock  sync.Mutex
+	files map[string]string
+	made  []string
+}
+
+func newTestFS(files map[string]string) *testFS {
+	if files == nil {
+		files = map[string]string{}
+	}
+	return &testFS{files: files}
+}
+
+func (fs *testFS) write(name, content string) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fs.files[name] = content
+}
+
+func (fs *testFS) madeTargets() []string {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	made := append([]string{}, fs.made...)
+	sort.Strings(made)
+	fs.made = nil
+	return made
+}
+
+var errFailed = errors.New("failed")
+
+// testSum returns a sum storage in a temporary directory; storage.Mem randomly retries transactions,
+// which would make recipes run more than once
+func testSum(t *testing.T) *YamlSumStorageFile {
+	d, err := ioutil.TempDir("", "go-make")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = os.RemoveAll(d) })
+	return &YamlSumStorageFile{Path: filepath.Join(d, "go-make.sum"), Perm: 0644}
+}
+
+// testTarget is a target in a testFS, its digest is its content
+type testTarget struct {
+	name string
+	fs   *testFS
+}
+
+func (tt *testTarget) Name() string {
+	return tt.name
+}
+
+func (tt *testTarget) Check(digest string) (TargetStatus, error) {
+	tt.fs.lock.Lock()
+	defer tt.fs.lock.Unlock()
+	content, exists := tt.fs.files[tt.name]
+	return TargetStatus{
+		UpToDate:      (digest == "" || digest == content) && exists,
+		Exists:        exists,
+		CurrentDigest: content,
+	}, nil
+}
+
+// testRule makes every target in its map depend on the listed prerequisites, making a target
+// concatenates the contents of its prerequisites
+type testRule struct {
+	fs        *testFS
+	prereqs   map[string][]string
+	orderOnly map[string][]string
+	recipe    string
+	fail      string
+}
+
+type testInvocation struct {
+	rule      *testRule
+	target    *testTarget
+	prereqs   []Target
+	orderOnly []Target
+}
+
+func (r *testRule) Match(target Target) (MatchQuality, Invocation, error) {
+	ps, ok := r.prereqs[target.Name()]
+	if !ok {
+		return NoMatch, nil, nil
+	}
+	prereqs := make([]Target, len(ps))
+	for i := range ps {
+		prereqs[i] = &testTarget{ps[i], r.fs}
+	}
+	var orderOnly []Target
+	for _, o := range r.orderOnly[target.Name()] {
+		orderOnly = append(orderOnly, &testTarget{o, r.fs})
+	}
+	return MatchImplicit, &testInvocation{r, &testTarget{target.Name(), r.fs}, prereqs, orderOnly}, nil
+}
+
+func (i *testInvocation) Prerequisites() []Target {
+	return i.prereqs
+}
+
+func (i *testInvocation) OrderOnly() []Target {
+	return i.orderOnly
+}
+
+func (i *testInvocation) Describe() ([]string, error) {
+	return []string{"make " + i.target.name}, nil
+}
+
+func (i *testInvocation) Digest(exec Executor) (string, error) {
+	return i.rule.recipe + i.target.name, nil
+}
+
+func (i *testInvocation) Execute(exec Executor, ctx context.Context) error {
+	if i.target.name == i.rule.fail {
+		return errFailed
+	}
+	fs := i.target.fs
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	content := make([]string, len(i.prereqs))
+	for k := range i.prereqs {
+		content[k] = fs.files[i.prereqs[k].Name()]
+	}
+	fs.files[i.target.name] = i.target.name + "(" + strings.Join(content, ",") + ")"
+	fs.made = append(fs.made, i.target.name)
+	return nil
+}
 
 func TestMake(t *testing.T) {
+	fs := newTestFS(map[string]string{"d": "d"})
+	m := &Make{
+		Sum:   testSum(t),
+		Rules: []Rule{&testRule{fs: fs, prereqs: map[string][]string{"a": {"b", "c"}, "b": {"c"}, "c": {"d"}}}},
+	}
+	require.NoError(t, m.Make(nil, context.TODO(), &testTarget{"a", fs}))
+	assert.Equal(t, []string{"a", "b", "c"}, fs.madeTargets())
+	assert.Equal(t, "a(b(c(d)),c(d))", fs.files["a"])
+
+	require.NoError(t, m.Make(nil, context.TODO(), &testTarget{"a", fs}))
+	assert.Empty(t, fs.madeTargets())
+
+	// remaking a modified target restores its digest, nothing depending on it needs to be made
+	fs.write("b", "modified")
+	require.NoError(t, m.Make(nil, context.TODO(), &testTarget{"a", fs}))
+	assert.Equal(t, []string{"b"}, fs.madeTargets())
+
+	fs.write("d", "d2")
+	require.NoError(t, m.Make(nil, context.TODO(), &testTarget{"a", fs}))
+	assert.Equal(t, []string{"a", "b", "c"}, fs.madeTargets())
+	assert.Equal(t, "a(b(c(d2)),c(d2))", fs.files["a"])
+
+	m.Rules[0].(*testRule).recipe = "changed"
+	require.NoError(t, m.Make(nil, context.TODO(), &testTarget{"c", fs}))
+	assert.Equal(t, []string{"c"}, fs.madeTargets())
+}
+
+func TestMakeFailure(t *testing.T) {
+	fs := newTestFS(map[string]string{"d": "d"})
+	rule := &testRule{fs: fs, prereqs: map[string][]string{"a": {"b", "c"}, "b": {"d"}, "c": {"d"}}, fail: "a"}
+	m := &Make{
+		Sum:   testSum(t),
+		Rules: []Rule{rule},
+	}
+	assert.True(t, errors.Is(m.Make(nil, context.TODO(), &testTarget{"a", fs}), errFailed))
+	assert.Equal(t, []string{"b", "c"}, fs.madeTargets())
+
+	// the records of targets made before the failure are kept
+	rule.fail = ""
+	fs.write("c", "modified")
+	require.NoError(t, m.Make(nil, context.TODO(), &testTarget{"a", fs}))
+	assert.Equal(t, []string{"a", "c"}, fs.madeTargets())
+}
+
+func TestMakeDryRun(t *testing.T) {
+	fs := newTestFS(map[string]string{"d": "d", "c": "c(d)"})
+	out := new(bytes.Buffer)
+	m := &Make{
+		Sum:    testSum(t),
+		Rules:  []Rule{&testRule{fs: fs, prereqs: map[string][]string{"a": {"b", "c"}, "b": {"c"}, "c": {"d"}}}},
+		DryRun: true,
+		Out:    out,
+	}
+	require.NoError(t, m.Make(nil, context.TODO(), &testTarget{"a", fs}))
+	assert.Empty(t, fs.madeTargets())
+	assert.Equal(t, "make b\nmake a\n", out.String())
+
+	m.DryRun = false
+	require.NoError(t, m.Make(nil, context.TODO(), &testTarget{"a", fs}))
+	assert.Equal(t, []string{"a", "b"}, fs.madeTargets())
+	fs.write("d", "d2")
+	m.DryRun = true
+	out.Reset()
+	require.NoError(t, m.Make(nil, context.TODO(), &testTarget{"a", fs}))
+	assert.Empty(t, fs.madeTargets())
+	assert.Equal(t, "make c\nmake b\nmake a\n", out.String())
+}
+
+func TestMakeQuestion(t *testing.T) {
+	fs := newTestFS(map[string]string{"d": "d", "c": "c(d)"})
+	m := &Make{
+		Sum:      testSum(t),
+		Rules:    []Rule{&testRule{fs: fs, prereqs: map[string][]string{"a": {"b", "c"}, "b": {"c"}, "c": {"d"}}}},
+		Question: true,
+	}
+	err := m.Make(nil, context.TODO(), &testTarget{"a", fs})
+	var outOfDate *OutOfDateError
+	require.True(t, errors.As(err, &outOfDate))
+	assert.Equal(t, "targets out of date: a, b", err.Error())
+	assert.Empty(t, fs.madeTargets())
+
+	assert.NoError(t, m.Make(nil, context.TODO(), &testTarget{"c", fs}))
+}
+
+func TestMakeExplain(t *testing.T) {
+	fs := newTestFS(map[string]string{"d": "d"})
+	rule := &testRule{fs: fs, prereqs: map[string][]string{"a": {"b"}, "b": {"d"}}}
+	var reasons map[string]Reason
+	m := &Make{
+		Sum:   testSum(t),
+		Rules: []Rule{rule},
+		Explain: func(target Target, reason Reason) {
+			reasons[target.Name()] = reason
+		},
+	}
+	explain := func() map[string]Reason {
+		reasons = map[string]Reason{}
+		require.NoError(t, m.Make(nil, context.TODO(), &testTarget{"a", fs}))
+		return reasons
+	}
+
+	assert.Equal(t, map[string]Reason{
+		"a": {Kind: ReasonNoRecord},
+		"b": {Kind: ReasonNoRecord},
+	}, explain())
+	assert.Empty(t, explain())
+
+	fs.write("d", "d2")
+	assert.Equal(t, map[string]Reason{
+		"a": {Kind: ReasonPrerequisiteChanged, Prerequisite: "b"},
+		"b": {Kind: ReasonPrerequisiteChanged, Prerequisite: "d"},
+	}, explain())
+
+	fs.write("a", "x")
+	assert.Equal(t, map[string]Reason{
+		"a": {Kind: ReasonDigestMismatch, OldDigest: "a(b(d2))", NewDigest: "x"},
+	}, explain())
+
+	fs.lock.Lock()
+	delete(fs.files, "a")
+	fs.lock.Unlock()
+	assert.Equal(t, map[string]Reason{"a": {Kind: ReasonMissing}}, explain())
+
+	rule.recipe = "v2"
+	assert.Equal(t, map[string]Reason{
+		"a": {Kind: ReasonRecipeChanged},
+		"b": {Kind: ReasonRecipeChanged},
+	}, explain())
+
+	m.AlwaysMake = true
+	assert.Equal(t, map[string]Reason{
+		"a": {Kind: ReasonForced},
+		"b": {Kind: ReasonForced},
+	}, explain())
+	assert.Equal(t, "prerequisite 'b' changed", Reason{Kind: ReasonPrerequisiteChanged, Prerequisite: "b"}.String())
+}
+
+func TestMakeEvents(t *testing.T) {
+	fs := newTestFS(map[string]string{"c": "c"})
+	var events []Event
+	m := &Make{
+		Sum:   testSum(t),
+		Rules: []Rule{&testRule{fs: fs, prereqs: map[string][]string{"a": {"b"}, "b": {"c"}}}},
+		Jobs:  1,
+		Events: EventSinkFunc(func(e Event) {
+			events = append(events, e)
+		}),
+	}
+	require.NoError(t, m.Make(nil, context.TODO(), &testTarget{"a", fs}))
+	require.NotEmpty(t, events)
+	assert.Equal(t, EventGraphComputed, events[0].Kind)
+	assert.Equal(t, 3, events[0].Targets)
+	assert.Equal(t, -1, events[0].Worker)
+
+	var kinds []string
+	for _, e := range events[1:] {
+		kinds = append(kinds, e.Kind.String()+" "+e.Target.Name())
+		if e.Kind != EventQueued {
+			assert.Equal(t, 0, e.Worker)
+		}
+		if e.Kind == EventExecuting {
+			assert.Equal(t, ReasonNoRecord, e.Reason.Kind)
+		}
+	}
+	assert.Equal(t, []string{
+		"queued c", "started c", "up-to-date c", "succeeded c",
+		"queued b", "started b", "executing b", "succeeded b",
+		"queued a", "started a", "executing a", "succeeded a",
+	}, kinds)
+}
+
+func TestMakeRecordedDurations(t *testing.T) {
+	fs := newTestFS(nil)
+	m := &Make{
+		Sum:   testSum(t),
+		Rules: []Rule{&testRule{fs: fs, prereqs: map[string][]string{"a": {}, "b": {}, "c": {}}}},
+		Jobs:  2,
+	}
+	targets := []Target{&testTarget{"a", fs}, &testTarget{"b", fs}, &testTarget{"c", fs}}
+	// first returns the targets the two workers start with, neither is made before both started
+	first := func() []string {
+		var lock sync.Mutex
+		var started []string
+		var wg sync.WaitGroup
+		wg.Add(2)
+		m.Events = EventSinkFunc(func(e Event) {
+			if e.Kind != EventStarted {
+				return
+			}
+			lock.Lock()
+			started = append(started, e.Target.Name())
+			n := len(started)
+			lock.Unlock()
+			if n <= 2 {
+				wg.Done()
+				wg.Wait()
+			}
+		})
+		require.NoError(t, m.Make(nil, context.TODO(), targets...))
+		sort.Strings(started[:2])
+		return started[:2]
+	}
+	assert.Equal(t, []string{"a", "b"}, first())
+
+	// targets that took longer the last time are made first
+	require.NoError(t, m.Sum.ReadWrite(context.TODO(), func(ctx context.Context, tr storage.Transaction) error {
+		var writes []storage.Write
+		for name, d := range map[string]time.Duration{"a": time.Second, "b": time.Second, "c": time.Hour} {
+			value, err := tr.ReadValue(ctx, name)
+			require.NoError(t, err)
+			rec, err := parseRecord(value)
+			require.NoError(t, err)
+			assert.NotZero(t, rec.Duration)
+			rec.Duration = d
+			writes = append(writes, storage.Write{Key: name, Value: rec.String()})
+		}
+		return tr.BufferWrites(writes)
+	}))
+	m.AlwaysMake = true
+	assert.Equal(t, []string{"a", "c"}, first())
+
+	// a single worker makes them by name regardless
+	m.Events, m.Jobs = nil, 1
+	fs.made = nil
+	require.NoError(t, m.Make(nil, context.TODO(), targets...))
+	assert.Equal(t, []string{"a", "b", "c"}, fs.made)
+}
+
+// poolRule makes targets without prerequisites, tracking how many of its invocations run at once
+type poolRule struct {
+	pools      map[string]int
+	lock       sync.Mutex
+	running    int
+	maxRunning int
+}
+
+type poolInvocation struct {
+	rule *poolRule
+}
+
+func (r *poolRule) Match(target Target) (MatchQuality, Invocation, error) {
+	return MatchImplicit, &poolInvocation{r}, nil
+}
+
+func (i *poolInvocation) Prerequisites() []Target {
+	return nil
+}
+
+func (i *poolInvocation) Describe() ([]string, error) {
+	return nil, nil
+}
+
+func (i *poolInvocation) Digest(exec Executor) (string, error) {
+	return "", nil
+}
+
+func (i *poolInvocation) Pools() map[string]int {
+	return i.rule.pools
+}
+
+func (i *poolInvocation) Execute(exec Executor, ctx context.Context) error {
+	r := i.rule
+	r.lock.Lock()
+	r.running++
+	if r.running > r.maxRunning {
+		r.maxRunning = r.running
+	}
+	r.lock.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	r.lock.Lock()
+	r.running--
+	r.lock.Unlock()
+	return nil
+}
+
+func TestMakePools(t *testing.T) {
+	fs := newTestFS(nil)
+	rule := &poolRule{pools: map[string]int{"heavy": 1, "light": 1}}
+	m := &Make{
+		Sum:   testSum(t),
+		Rules: []Rule{rule},
+		Jobs:  8,
+		Pools: map[string]int{"heavy": 2, "light": 8},
+	}
+	var targets []Target
+	for _, name := range []string{"a", "b", "c", "d", "e", "f"} {
+		targets = append(targets, &testTarget{name, fs})
+	}
+	require.NoError(t, m.Make(nil, context.TODO(), targets...))
+	assert.Equal(t, 2, rule.maxRunning)
+
+	rule.pools = map[string]int{"heavy": 3}
+	assert.EqualError(t, m.Make(nil, context.TODO(), targets[0]),
+		"target 'a' needs 3 units of pool 'heavy', but it only has 2")
+	rule.pools = map[string]int{"heavy": -1}
+	assert.EqualError(t, m.Make(nil, context.TODO(), targets[0]),
+		"target 'a' needs -1 units of pool 'heavy', but needs to use at least one")
+	rule.pools = map[string]int{"other": 1}
+	err := m.Make(nil, context.TODO(), targets[0])
+	assert.True(t, errors.Is(err, ErrUnknownPool))
+}
+
+// groupRule makes all of its outputs at once from the target src, counting how often it did. It
+// matches the targets in match, defaulting to its outputs.
+type groupRule struct {
+	fs       *testFS
+	outputs  []string
+	match    []string
+	executed int
+}
+
+type groupInvocation struct {
+	rule *groupRule
+}
+
+func (r *groupRule) Match(target Target) (MatchQuality, Invocation, error) {
+	match := r.match
+	if match == nil {
+		match = r.outputs
+	}
+	for _, o := range match {
+		if o == target.Name() {
+			return MatchExplicit, &groupInvocation{r}, nil
+		}
+	}
+	return NoMatch, nil, nil
+}
+
+func (i *groupInvocation) Prerequisites() []Target {
+	return []Target{&testTarget{"src", i.rule.fs}}
+}
+
+func (i *groupInvocation) Outputs() []Target {
+	outputs := make([]Target, len(i.rule.outputs))
+	for k, o := range i.rule.outputs {
+		outputs[k] = &testTarget{o, i.rule.fs}
+	}
+	return outputs
+}
+
+func (i *groupInvocation) Describe() ([]string, error) {
+	return []string{"generate"}, nil
+}
+
+func (i *groupInvocation) Digest(exec Executor) (string, error) {
+	return "generate", nil
+}
+
+func (i *groupInvocation) Execute(exec Executor, ctx context.Context) error {
+	fs := i.rule.fs
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	i.rule.executed++
+	for _, o := range i.rule.outputs {
+		fs.files[o] = o + "(" + fs.files["src"] + ")"
+	}
+	return nil
+}
+
+func TestMakeGroup(t *testing.T) {
+	fs := newTestFS(map[string]string{"src": "s"})
+	group := &groupRule{fs: fs, outputs: []string{"gen_b", "gen_a"}}
+	m := &Make{
+		Sum:   testSum(t),
+		Rules: []Rule{group, &testRule{fs: fs, prereqs: map[string][]string{"app": {"gen_a", "gen_b"}}}},
+		Jobs:  4,
+	}
+	require.NoError(t, m.Make(nil, context.TODO(), &testTarget{"gen_b", fs}))
+	assert.Equal(t, 1, group.executed)
+	assert.Equal(t, "gen_a(s)", fs.files["gen_a"])
+
+	// every output was recorded
+	require.NoError(t, m.Make(nil, context.TODO(), &testTarget{"gen_a", fs}, &testTarget{"gen_b", fs}))
+	assert.Equal(t, 1, group.executed)
+
+	fs.write("src", "s2")
+	require.NoError(t, m.Make(nil, context.TODO(), &testTarget{"app", fs}))
+	assert.Equal(t, 2, group.executed)
+	assert.Equal(t, []string{"app"}, fs.madeTargets())
+	assert.Equal(t, "app(gen_a(s2),gen_b(s2))", fs.files["app"])
+
+	// a missing output makes the whole group again
+	fs.lock.Lock()
+	delete(fs.files, "gen_b")
+	fs.lock.Unlock()
+	require.NoError(t, m.Make(nil, context.TODO(), &testTarget{"gen_a", fs}))
+	assert.Equal(t, 3, group.executed)
+	assert.Equal(t, "gen_b(s2)", fs.files["gen_b"])
+
+	var events []string
+	m.Events = EventSinkFunc(func(e Event) {
+		if e.Kind == EventUpToDate {
+			events = append(events, e.Target.Name())
+		}
+	})
+	require.NoError(t, m.Make(nil, context.TODO(), &testTarget{"gen_b", fs}))
+	assert.Equal(t, 3, group.executed)
+	assert.Equal(t, []string{"src", "gen_a", "gen_b"}, events)
+	m.Events = nil
+
+	m.Question = true
+	fs.write("src", "s3")
+	err := m.Make(nil, context.TODO(), &testTarget{"gen_a", fs})
+	assert.EqualError(t, err, "targets out of date: gen_a, gen_b")
+}
+
+func TestMakeGroupConflict(t *testing.T) {
+	fs := newTestFS(map[string]string{"src": "s"})
+	group := &groupRule{fs: fs, outputs: []string{"gen_b", "gen_a"}, match: []string{"gen_b"}}
+	m := &Make{
+		Sum:   testSum(t),
+		Rules: []Rule{group, &testRule{fs: fs, prereqs: map[string][]string{"gen_a": {"src"}}}},
+	}
+	for _, targets := range [][]Target{
+		{&testTarget{"gen_b", fs}},
+		{&testTarget{"gen_a", fs}, &testTarget{"gen_b", fs}},
+	} {
+		err := m.Make(nil, context.TODO(), targets...)
+		assert.True(t, errors.Is(err, ErrGroupConflict))
+	}
+	assert.Equal(t, 0, group.executed)
+	assert.Empty(t, fs.madeTargets())
+
+	// without any rule matching the first output
+	m.Rules = m.Rules[:1]
+	err := m.Make(nil, context.TODO(), &testTarget{"gen_b", fs})
+	assert.True(t, errors.Is(err, ErrGroupConflict))
+}
+
+func TestMakeOrderOnly(t *testing.T) {
+	fs := newTestFS(map[string]string{"src": "s"})
+	m := &Make{
+		Sum: testSum(t),
+		Rules: []Rule{&testRule{
+			fs:        fs,
+			prereqs:   map[string][]string{"a": {"src"}, "dir": {}},
+			orderOnly: map[string][]string{"a": {"dir"}},
+		}},
+		Jobs: 4,
+	}
+	require.NoError(t, m.Make(nil, context.TODO(), &testTarget{"a", fs}))
+	fs.lock.Lock()
+	assert.Equal(t, []string{"dir", "a"}, fs.made)
+	fs.lock.Unlock()
+	assert.Equal(t, "a(s)", fs.files["a"])
+	fs.madeTargets()
+
+	// order-only prerequisites only have to exist and do not make the target out of date
+	fs.write("dir", "changed")
+	require.NoError(t, m.Make(nil, context.TODO(), &testTarget{"a", fs}))
+	assert.Empty(t, fs.madeTargets())
+	fs.lock.Lock()
+	delete(fs.files, "dir")
+	fs.lock.Unlock()
+	require.NoError(t, m.Make(nil, context.TODO(), &testTarget{"a", fs}))
+	assert.Equal(t, []string{"dir"}, fs.madeTargets())
+
+	// as a target of its own, it is made as usual
+	fs.write("dir", "changed")
+	require.NoError(t, m.Make(nil, context.TODO(), &testTarget{"a", fs}, &testTarget{"dir", fs}))
+	assert.Equal(t, []string{"dir"}, fs.madeTargets())
+	m.AlwaysMake = true
+	require.NoError(t, m.Make(nil, context.TODO(), &testTarget{"a", fs}))
+	assert.Equal(t, []string{"a", "dir"}, fs.madeTargets())
+	m.AlwaysMake = false
+
+	fs.write("src", "s2")
+	require.NoError(t, m.Make(nil, context.TODO(), &testTarget{"a", fs}))
+	assert.Equal(t, []string{"a"}, fs.madeTargets())
+}
 
+func TestMakeCycle(t *testing.T) {
+	fs := newTestFS(nil)
+	m := &Make{
+		Sum:   testSum(t),
+		Rules: []Rule{&testRule{fs: fs, prereqs: map[string][]string{"a": {"b"}, "b": {"a"}}}},
+	}
+	err := m.Make(nil, context.TODO(), &testTarget{"a", fs})
+	var cycleErr *CycleError
+	require.True(t, errors.As(err, &cycleErr))
+	assert.Equal(t, "dependency cycle: b -> a -> b", cycleErr.Error())
 }
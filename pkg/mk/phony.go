@@ -0,0 +1,25 @@
+package mk
+
+import (
+	"net/url"
+)
+
+// PhonyTarget is a target not backed by a file, e.g. "all" or "test". It never exists, so its rule
+// runs every time it is made, and so do the rules of the targets depending on it.
+type PhonyTarget struct {
+	Label string
+}
+
+func init() {
+	RegisterTarget("phony", func(u url.URL) Target {
+		return &PhonyTarget{Label: urlPath(u)}
+	})
+}
+
+func (p *PhonyTarget) Name() string {
+	return "phony:" + (&url.URL{Path: p.Label}).EscapedPath()
+}
+
+func (p *PhonyTarget) Check(digest string) (TargetStatus, error) {
+	return TargetStatus{}, nil
+}
@@ -0,0 +1,55 @@
+package mk
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"sort"
+)
+
+var ErrUnknownPool = fmt.Errorf("unknown pool")
+
+// PooledInvocation is implemented by invocations which need units of resource pools while they
+// execute, e.g. to limit how many memory heavy recipes run at once regardless of Make.Jobs
+type PooledInvocation interface {
+	// Pools returns the number of units needed of each pool by name
+	Pools() map[string]int
+}
+
+// poolUnits returns the units of pools needed by the targets which need any, checking that the
+// pools exist and have enough units
+func (g *DAG) poolUnits() (map[Target]map[string]int, error) {
+	if g.Units == nil {
+		return nil, nil
+	}
+	// in a stable order, to report the same error every time
+	targets := make([]Target, 0, len(g.graph))
+	for t := range g.graph {
+		targets = append(targets, t)
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Name() < targets[j].Name() })
+	units := make(map[Target]map[string]int)
+	for _, t := range targets {
+		needed := g.Units(t)
+		names := make([]string, 0, len(needed))
+		for name := range needed {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			n := needed[name]
+			capacity, ok := g.Pools[name]
+			switch {
+			case !ok:
+				return nil, errors.Wrapf(ErrUnknownPool, "pool '%s' of target '%s'", name, t.Name())
+			case n <= 0:
+				return nil, fmt.Errorf("target '%s' needs %d units of pool '%s', but needs to use at least one", t.Name(), n, name)
+			case n > capacity:
+				return nil, fmt.Errorf("target '%s' needs %d units of pool '%s', but it only has %d", t.Name(), n, name, capacity)
+			}
+		}
+		if len(needed) > 0 {
+			units[t] = needed
+		}
+	}
+	return units, nil
+}
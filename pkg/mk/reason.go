@@ -0,0 +1,49 @@
+package mk
+
+import "fmt"
+
+// ReasonKind tells why a target is made
+type ReasonKind int
+
+const (
+	// ReasonNoRecord is a target that does not exist and was never made
+	ReasonNoRecord ReasonKind = iota
+	// ReasonMissing is a target that was made before, but does not exist anymore
+	ReasonMissing
+	// ReasonDigestMismatch is a target whose digest differs from the one recorded when it was made
+	ReasonDigestMismatch
+	// ReasonPrerequisiteChanged is a target with a prerequisite that was remade or changed since
+	ReasonPrerequisiteChanged
+	// ReasonRecipeChanged is a target whose invocation digest differs from the recorded one
+	ReasonRecipeChanged
+	// ReasonForced is an up-to-date target made anyway, see Make.AlwaysMake
+	ReasonForced
+)
+
+// Reason explains why a target is made
+type Reason struct {
+	Kind ReasonKind
+	// Prerequisite is the name of the changed prerequisite for ReasonPrerequisiteChanged
+	Prerequisite string
+	// OldDigest and NewDigest are the recorded and the current digest for ReasonDigestMismatch
+	OldDigest string
+	NewDigest string
+}
+
+func (r Reason) String() string {
+	switch r.Kind {
+	case ReasonNoRecord:
+		return "target does not exist and has no previous record"
+	case ReasonMissing:
+		return "target does not exist anymore"
+	case ReasonDigestMismatch:
+		return fmt.Sprintf("digest changed from '%s' to '%s'", r.OldDigest, r.NewDigest)
+	case ReasonPrerequisiteChanged:
+		return fmt.Sprintf("prerequisite '%s' changed", r.Prerequisite)
+	case ReasonRecipeChanged:
+		return "recipe changed"
+	case ReasonForced:
+		return "forced"
+	}
+	return fmt.Sprintf("unknown reason %d", r.Kind)
+}
@@ -0,0 +1,53 @@
+package mk
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// record is what gets stored in the sum storage for a made target: its own digest, the digests of
+// its prerequisites at the time it was made, the digest of the invocation that made it and how long
+// that took
+type record struct {
+	Digest        string            `json:"digest"`
+	Prerequisites map[string]string `json:"prerequisites,omitempty"`
+	Recipe        string            `json:"recipe,omitempty"`
+	Duration      time.Duration     `json:"duration,omitempty"`
+}
+
+// parseRecord parses a stored record. Plain digests as stored by earlier versions are accepted as
+// records without prerequisites.
+func parseRecord(value string) (record, error) {
+	var r record
+	if !strings.HasPrefix(value, "{") {
+		r.Digest = value
+		return r, nil
+	}
+	err := json.Unmarshal([]byte(value), &r)
+	return r, err
+}
+
+func (r record) String() string {
+	b, err := json.Marshal(r)
+	if err != nil {
+		panic(err)
+	}
+	return string(b)
+}
+
+// changedPrerequisite returns the name of a prerequisite whose digest differs from the record, or
+// an empty string if there is none
+func (r record) changedPrerequisite(digests map[string]string) string {
+	for name, digest := range digests {
+		if old, ok := r.Prerequisites[name]; !ok || old != digest {
+			return name
+		}
+	}
+	for name := range r.Prerequisites {
+		if _, ok := digests[name]; !ok {
+			return name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,72 @@
+package shell
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// OutputMode determines what happens with the output of recipes
+type OutputMode int
+
+const (
+	// OutputLog logs every line of output at trace level
+	OutputLog OutputMode = iota
+	// OutputStream writes output as it is produced, prefixing each line with the target
+	OutputStream
+	// OutputTarget buffers the output of a target and writes it at once when the target is done
+	OutputTarget
+)
+
+// OutputError attaches the output captured from the recipes of a target to their error
+type OutputError struct {
+	Err    error
+	Stdout []byte
+	Stderr []byte
+}
+
+func (e *OutputError) Error() string {
+	stderr := strings.TrimSpace(string(e.Stderr))
+	if stderr == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%v: %s", e.Err, stderr)
+}
+
+func (e *OutputError) Unwrap() error {
+	return e.Err
+}
+
+// lineWriter calls a function for every line written to it, the last line being passed on Close
+// even if it is not terminated
+type lineWriter struct {
+	lock sync.Mutex
+	buf  []byte
+	line func(line string)
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.line(string(w.buf[:i]))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+func (w *lineWriter) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if len(w.buf) > 0 {
+		w.line(string(w.buf))
+		w.buf = nil
+	}
+	return nil
+}
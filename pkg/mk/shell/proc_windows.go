@@ -0,0 +1,21 @@
+//go:build windows
+// +build windows
+
+package shell
+
+import (
+	"os"
+	"os/exec"
+)
+
+func setProcessGroup(c *exec.Cmd) {
+}
+
+// terminate kills the process, as there is no way to ask it to terminate
+func terminate(p *os.Process) error {
+	return p.Kill()
+}
+
+func kill(p *os.Process) error {
+	return p.Kill()
+}
@@ -1,53 +1,208 @@
 package shell
 
 import (
-	"bufio"
+	"bytes"
 	"context"
+	"fmt"
 	"github.com/rs/zerolog"
+	"github.com/tobiash/go-make/pkg/mk"
 	"io"
+	"io/ioutil"
+	"os"
 	"os/exec"
+	"sync"
+	"time"
 )
 
 var DefaultShell = []string{"/usr/bin/env", "sh", "-c"}
 
+var ErrEmptyShell = fmt.Errorf("empty shell command")
+
+// DefaultKillGrace is the time a cancelled recipe is given to terminate before it is killed
+const DefaultKillGrace = 5 * time.Second
+
 type ShellExecutor struct {
 	ShellCmd []string
 	Dir      string
 	Env      []string
+	// KillGrace is the time between asking the processes of a cancelled recipe to terminate and
+	// killing them, defaults to DefaultKillGrace
+	KillGrace time.Duration
+	// Output determines how the output of recipes is passed on
+	Output OutputMode
+	// Stdout and Stderr receive the output of recipes unless it is logged, default to the standard
+	// output and error of the process
+	Stdout, Stderr io.Writer
+
+	lock sync.Mutex
 }
 
-func (s *ShellExecutor) shell() []string {
-	if s.ShellCmd == nil {
+// targetExecutor runs the recipes for a single target, capturing their output
+type targetExecutor struct {
+	*ShellExecutor
+	target         string
+	stdout, stderr bytes.Buffer
+	closers        []io.Closer
+	out, err       io.Writer
+}
+
+// Shell returns the command line recipes are appended to, DefaultShell if ShellCmd is empty
+func (s *ShellExecutor) Shell() []string {
+	if len(s.ShellCmd) == 0 {
 		return DefaultShell
 	}
 	return s.ShellCmd
 }
 
+func (s *ShellExecutor) killGrace() time.Duration {
+	if s.KillGrace == 0 {
+		return DefaultKillGrace
+	}
+	return s.KillGrace
+}
+
+// Scope returns an executor capturing the output of the recipes for a target. The returned function
+// passes on buffered output and attaches the captured output to errors.
+func (s *ShellExecutor) Scope(target mk.Target) (mk.Executor, func(error) error) {
+	t := s.scope(target.Name())
+	return t, t.finish
+}
+
+func (s *ShellExecutor) scope(target string) *targetExecutor {
+	return &targetExecutor{ShellExecutor: s, target: target}
+}
+
+// RunShell runs a command using the shell. The command is started in its own process group, which
+// is terminated when the context is cancelled.
 func (s *ShellExecutor) RunShell(ctx context.Context, cmd string) error {
+	return s.RunShellWith(ctx, s.Shell(), cmd)
+}
+
+// RunShellWith runs a command like RunShell, but using the given shell command line
+func (s *ShellExecutor) RunShellWith(ctx context.Context, shell []string, cmd string) error {
+	t := s.scope("")
+	return t.finish(t.RunShellWith(ctx, shell, cmd))
+}
+
+func (t *targetExecutor) RunShell(ctx context.Context, cmd string) error {
+	return t.RunShellWith(ctx, t.Shell(), cmd)
+}
+
+func (t *targetExecutor) RunShellWith(ctx context.Context, shell []string, cmd string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(shell) == 0 || shell[0] == "" {
+		return ErrEmptyShell
+	}
 	log := zerolog.Ctx(ctx)
-	shell := s.shell()
 	args := append([]string{}, shell[1:]...)
 	args = append(args, cmd)
 	c := exec.Command(shell[0], args...)
-	if s.Dir != "" {
-		c.Dir = s.Dir
+	if t.Dir != "" {
+		c.Dir = t.Dir
 	}
-	if len(s.Env) > 0 {
-		c.Env = s.Env
+	if len(t.Env) > 0 {
+		c.Env = t.Env
 	}
-	lw := logWriter(log)
-	c.Stderr = lw
-	c.Stdout = lw
-	return c.Run()
-}
+	stdout, stderr := t.writers(log)
+	c.Stdout = io.MultiWriter(&t.stdout, stdout)
+	c.Stderr = io.MultiWriter(&t.stderr, stderr)
+	setProcessGroup(c)
+	if err := c.Start(); err != nil {
+		return err
+	}
+	waitErr := make(chan error, 1)
+	go func() { waitErr <- c.Wait() }()
 
-func logWriter(l *zerolog.Logger) io.WriteCloser {
-	pr, pw := io.Pipe()
-	scanner := bufio.NewScanner(pr)
-	go func() {
-		for scanner.Scan() {
-			l.Trace().Msg(scanner.Text())
+	select {
+	case err := <-waitErr:
+		return err
+	case <-ctx.Done():
+	}
+	log.Debug().Int("pid", c.Process.Pid).Msg("terminating recipe")
+	if err := terminate(c.Process); err != nil {
+		log.Debug().Err(err).Msg("error terminating recipe")
+	}
+	grace := time.NewTimer(t.killGrace())
+	defer grace.Stop()
+	select {
+	case <-waitErr:
+	case <-grace.C:
+		log.Debug().Int("pid", c.Process.Pid).Msg("killing recipe")
+		if err := kill(c.Process); err != nil {
+			log.Debug().Err(err).Msg("error killing recipe")
 		}
-	}()
-	return pw
+		<-waitErr
+	}
+	return ctx.Err()
+}
+
+// writers returns the writers passing on the output of the target's recipes according to the
+// output mode, creating them on first use
+func (t *targetExecutor) writers(log *zerolog.Logger) (io.Writer, io.Writer) {
+	if t.out != nil {
+		return t.out, t.err
+	}
+	switch t.Output {
+	case OutputStream:
+		t.out, t.err = t.prefixWriter(t.stdoutWriter()), t.prefixWriter(t.stderrWriter())
+	case OutputTarget:
+		// output is captured anyway and written when the target is done
+		t.out, t.err = ioutil.Discard, ioutil.Discard
+	default:
+		logLine := func(line string) { log.Trace().Msg(line) }
+		t.out, t.err = t.lineWriter(logLine), t.lineWriter(logLine)
+	}
+	return t.out, t.err
+}
+
+func (t *targetExecutor) lineWriter(line func(string)) io.Writer {
+	w := &lineWriter{line: line}
+	t.closers = append(t.closers, w)
+	return w
+}
+
+func (t *targetExecutor) prefixWriter(w io.Writer) io.Writer {
+	prefix := ""
+	if t.target != "" {
+		prefix = fmt.Sprintf("[%s] ", t.target)
+	}
+	return t.lineWriter(func(line string) {
+		t.lock.Lock()
+		defer t.lock.Unlock()
+		_, _ = fmt.Fprintf(w, "%s%s\n", prefix, line)
+	})
+}
+
+func (s *ShellExecutor) stdoutWriter() io.Writer {
+	if s.Stdout == nil {
+		return os.Stdout
+	}
+	return s.Stdout
+}
+
+func (s *ShellExecutor) stderrWriter() io.Writer {
+	if s.Stderr == nil {
+		return os.Stderr
+	}
+	return s.Stderr
+}
+
+// finish passes on remaining output once all recipes of the target ran and attaches the captured
+// output to their error
+func (t *targetExecutor) finish(err error) error {
+	for _, c := range t.closers {
+		_ = c.Close()
+	}
+	if t.Output == OutputTarget {
+		t.lock.Lock()
+		_, _ = t.stdoutWriter().Write(t.stdout.Bytes())
+		_, _ = t.stderrWriter().Write(t.stderr.Bytes())
+		t.lock.Unlock()
+	}
+	if err == nil {
+		return nil
+	}
+	return &OutputError{Err: err, Stdout: t.stdout.Bytes(), Stderr: t.stderr.Bytes()}
 }
@@ -0,0 +1,71 @@
+//go:build !windows
+// +build !windows
+
+package shell
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tobiash/go-make/pkg/mk"
+	"testing"
+	"time"
+)
+
+func TestRunShell(t *testing.T) {
+	se := &ShellExecutor{}
+	assert.NoError(t, se.RunShell(context.TODO(), "true"))
+	assert.Error(t, se.RunShell(context.TODO(), "exit 1"))
+
+	se = &ShellExecutor{ShellCmd: []string{}}
+	assert.Equal(t, DefaultShell, se.Shell())
+	assert.NoError(t, se.RunShell(context.TODO(), "true"))
+	for _, shell := range [][]string{nil, {}, {""}} {
+		err := se.RunShellWith(context.TODO(), shell, "true")
+		assert.True(t, errors.Is(err, ErrEmptyShell))
+	}
+}
+
+func TestRunShellCancel(t *testing.T) {
+	se := &ShellExecutor{KillGrace: 100 * time.Millisecond}
+	for _, cmd := range []string{
+		"sleep 30 & sleep 30; wait",
+		// ignores SIGTERM, so it needs to be killed after the grace period
+		"trap '' TERM; sleep 30 & sleep 30; wait",
+	} {
+		ctx, cancel := context.WithTimeout(context.TODO(), 200*time.Millisecond)
+		start := time.Now()
+		err := se.RunShell(ctx, cmd)
+		cancel()
+		assert.True(t, errors.Is(err, context.DeadlineExceeded))
+		assert.Less(t, int64(time.Since(start)), int64(5*time.Second), cmd)
+	}
+}
+
+func TestOutputModes(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	se := &ShellExecutor{Output: OutputStream, Stdout: &stdout, Stderr: &stderr}
+	exec, finish := se.Scope(&mk.FileTarget{Path: "a"})
+	require.NoError(t, exec.(*targetExecutor).RunShell(context.TODO(), "echo out; echo err >&2; printf partial"))
+	assert.Equal(t, "[file://a] out\n", stdout.String())
+	assert.NoError(t, finish(nil))
+	assert.Equal(t, "[file://a] out\n[file://a] partial\n", stdout.String())
+	assert.Equal(t, "[file://a] err\n", stderr.String())
+
+	stdout.Reset()
+	stderr.Reset()
+	se.Output = OutputTarget
+	exec, finish = se.Scope(&mk.FileTarget{Path: "a"})
+	require.NoError(t, exec.(*targetExecutor).RunShell(context.TODO(), "echo out"))
+	err := exec.(*targetExecutor).RunShell(context.TODO(), "echo failed >&2; exit 1")
+	assert.Empty(t, stdout.String())
+	err = finish(err)
+	var outputErr *OutputError
+	require.True(t, errors.As(err, &outputErr))
+	assert.Equal(t, "exit status 1: failed", err.Error())
+	assert.Equal(t, "out\n", string(outputErr.Stdout))
+	assert.Equal(t, "out\n", stdout.String())
+	assert.Equal(t, "failed\n", stderr.String())
+}
@@ -3,23 +3,50 @@ package mk
 import (
 	"bufio"
 	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
 	"golang.org/x/mod/sumdb/storage"
 	"gopkg.in/yaml.v2"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 )
 
+// ErrLocked is returned if the sum file stays locked by another process for longer than allowed
+var ErrLocked = errors.New("sum file is locked by another process")
+
+// lockPollInterval is the interval in which a locked sum file is checked
+const lockPollInterval = 50 * time.Millisecond
+
+// YamlSumStorageFile stores digests in a YAML file. Writes of a ReadWrite transaction are appended
+// to a journal next to the file as they happen and are committed to the file even if the
+// transaction fails, so the work of a failed or killed run is not lost.
+//
+// Transactions hold a lock on a lock file next to the file, shared for ReadOnly and exclusive for
+// ReadWrite, so processes using the same file do not interfere. The lock is taken with flock on
+// unix and LockFileEx on windows.
 type YamlSumStorageFile struct {
 	Path string
 	Perm os.FileMode
+	// LockTimeout is the time to wait for the lock held by another process before failing with
+	// ErrLocked. Zero waits until the context is done, a negative value fails immediately.
+	LockTimeout time.Duration
 }
 
 type yamlStorageFileTransaction struct {
 	sum             map[string]string
 	dirty, readOnly bool
 	lock            sync.Mutex
+	journal         *os.File
+}
+
+// journalEntry is a line of the journal
+type journalEntry struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
 }
 
 func (y *yamlStorageFileTransaction) ReadValue(ctx context.Context, key string) (value string, err error) {
@@ -41,6 +68,9 @@ func (y *yamlStorageFileTransaction) ReadValues(ctx context.Context, keys []stri
 func (y *yamlStorageFileTransaction) BufferWrites(writes []storage.Write) error {
 	y.lock.Lock()
 	defer y.lock.Unlock()
+	if y.readOnly {
+		return errors.New("cannot write in a read-only transaction")
+	}
 	if len(writes) == 0 {
 		return nil
 	}
@@ -48,64 +78,184 @@ func (y *yamlStorageFileTransaction) BufferWrites(writes []storage.Write) error
 	for i := range writes {
 		y.sum[writes[i].Key] = writes[i].Value
 	}
-	return nil
+	if y.journal == nil {
+		return nil
+	}
+	enc := json.NewEncoder(y.journal)
+	for i := range writes {
+		if err := enc.Encode(journalEntry{Key: writes[i].Key, Value: writes[i].Value}); err != nil {
+			return err
+		}
+	}
+	return y.journal.Sync()
+}
+
+func (j *YamlSumStorageFile) lockPath() string {
+	return j.Path + ".lock"
+}
+
+// lock acquires the lock of the file, returning a function to release it
+func (j *YamlSumStorageFile) lock(ctx context.Context, exclusive bool) (func(), error) {
+	if dir := filepath.Dir(j.Path); dir != "" {
+		_ = os.MkdirAll(dir, 0700)
+	}
+	file, err := os.OpenFile(j.lockPath(), os.O_CREATE|os.O_RDWR, j.perm())
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	for {
+		locked, err := tryLockFile(file, exclusive)
+		switch {
+		case err != nil:
+			_ = file.Close()
+			return nil, errors.Wrapf(err, "error locking %s", j.lockPath())
+		case locked:
+			return func() {
+				_ = unlockFile(file)
+				_ = file.Close()
+			}, nil
+		case j.LockTimeout < 0 || (j.LockTimeout > 0 && time.Since(start) >= j.LockTimeout):
+			_ = file.Close()
+			return nil, ErrLocked
+		}
+		select {
+		case <-ctx.Done():
+			_ = file.Close()
+			return nil, ctx.Err()
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
+
+func (j *YamlSumStorageFile) journalPath() string {
+	return j.Path + ".journal"
+}
+
+func (j *YamlSumStorageFile) perm() os.FileMode {
+	if j.Perm == 0 {
+		return 0644
+	}
+	return j.Perm
 }
 
 func (j *YamlSumStorageFile) read() (*yamlStorageFileTransaction, error) {
-	var tr yamlStorageFileTransaction
+	tr := yamlStorageFileTransaction{sum: make(map[string]string)}
+	if err := j.readSum(&tr); err != nil {
+		return nil, err
+	}
+	if err := j.replayJournal(&tr); err != nil {
+		return nil, err
+	}
+	return &tr, nil
+}
+
+func (j *YamlSumStorageFile) readSum(tr *yamlStorageFileTransaction) error {
 	file, err := os.Open(j.Path)
 	if os.IsNotExist(err) {
-		tr.sum = make(map[string]string)
-		return &tr, nil
+		return nil
 	} else if err != nil {
-		return nil, err
+		return err
 	}
 	defer func() { _ = file.Close() }()
 	rdr := bufio.NewReader(file)
 	if _, err = rdr.Peek(1); err == io.EOF {
-		return &tr, nil
+		return nil
 	} else if err != nil {
-		return nil, err
+		return err
 	}
-	if err := yaml.NewDecoder(rdr).Decode(&tr.sum); err != nil {
-		return nil, err
+	return yaml.NewDecoder(rdr).Decode(&tr.sum)
+}
+
+// replayJournal applies the writes of a run that did not get to commit them. An incomplete last
+// entry, left by a process killed while writing it, is ignored.
+func (j *YamlSumStorageFile) replayJournal(tr *yamlStorageFileTransaction) error {
+	file, err := os.Open(j.journalPath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer func() { _ = file.Close() }()
+	dec := json.NewDecoder(file)
+	for {
+		var e journalEntry
+		if err := dec.Decode(&e); err != nil {
+			return nil
+		}
+		tr.sum[e.Key] = e.Value
+		tr.dirty = true
 	}
-	return &tr, nil
 }
 
 func (j *YamlSumStorageFile) ReadOnly(ctx context.Context, f func(context.Context, storage.Transaction) error) error {
+	unlock, err := j.lock(ctx, false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	tr, err := j.read()
 	if err != nil {
 		return err
 	}
+	tr.readOnly = true
 	return f(ctx, tr)
 }
 
+// ReadWrite runs a transaction. Unlike other storage implementations, writes are committed even if
+// f fails.
 func (j *YamlSumStorageFile) ReadWrite(ctx context.Context, f func(context.Context, storage.Transaction) error) error {
+	unlock, err := j.lock(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	tr, err := j.read()
 	if err != nil {
 		return err
 	}
-	if err := f(ctx, tr); err != nil {
+	tr.journal, err = os.OpenFile(j.journalPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, j.perm())
+	if err != nil {
 		return err
 	}
-	if ctx.Err() != nil {
-		return ctx.Err()
+	err = f(ctx, tr)
+	_ = tr.journal.Close()
+	if err == nil {
+		err = ctx.Err()
 	}
-	if !tr.dirty {
-		return nil
+	if tr.dirty {
+		if werr := j.write(tr.sum); werr != nil {
+			return werr
+		}
 	}
-	dir := filepath.Dir(j.Path)
-	if dir != "" {
-		_ = os.MkdirAll(dir, 0700)
+	if rerr := os.Remove(j.journalPath()); rerr != nil && !os.IsNotExist(rerr) {
+		return rerr
 	}
-	file, err := os.OpenFile(j.Path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, j.Perm)
+	return err
+}
+
+// write replaces the file with the given digests, writing them to a temporary file renamed over it
+// so the file is never left half-written
+func (j *YamlSumStorageFile) write(sum map[string]string) error {
+	file, err := ioutil.TempFile(filepath.Dir(j.Path), filepath.Base(j.Path)+".*.tmp")
 	if err != nil {
 		return err
 	}
-	if err := yaml.NewEncoder(file).Encode(tr.sum); err != nil {
+	defer func() { _ = os.Remove(file.Name()) }()
+	if err := yaml.NewEncoder(file).Encode(sum); err != nil {
 		_ = file.Close()
 		return err
 	}
-	return file.Close()
+	if err := file.Chmod(j.perm()); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), j.Path)
 }
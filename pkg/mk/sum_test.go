@@ -0,0 +1,113 @@
+package mk
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/mod/sumdb/storage"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestYamlSumStorageFile(t *testing.T) {
+	d, err := ioutil.TempDir("", "go-make")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(d) }()
+	sum := &YamlSumStorageFile{Path: filepath.Join(d, "go-make.sum")}
+	read := func(key string) string {
+		var value string
+		require.NoError(t, sum.ReadOnly(context.TODO(), func(ctx context.Context, tr storage.Transaction) error {
+			value, err = tr.ReadValue(ctx, key)
+			return err
+		}))
+		return value
+	}
+
+	require.NoError(t, sum.ReadWrite(context.TODO(), func(ctx context.Context, tr storage.Transaction) error {
+		return tr.BufferWrites([]storage.Write{{Key: "a", Value: "1"}})
+	}))
+	assert.Equal(t, "1", read("a"))
+
+	// writes are kept even if the transaction fails
+	assert.Equal(t, errFailed, sum.ReadWrite(context.TODO(), func(ctx context.Context, tr storage.Transaction) error {
+		require.NoError(t, tr.BufferWrites([]storage.Write{{Key: "b", Value: "2"}}))
+		return errFailed
+	}))
+	assert.Equal(t, "1", read("a"))
+	assert.Equal(t, "2", read("b"))
+	_, err = os.Stat(sum.journalPath())
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestYamlSumStorageFileJournal(t *testing.T) {
+	d, err := ioutil.TempDir("", "go-make")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(d) }()
+	sum := &YamlSumStorageFile{Path: filepath.Join(d, "go-make.sum")}
+	require.NoError(t, ioutil.WriteFile(sum.Path, []byte("a: \"1\"\n"), 0644))
+	// journal of a killed process, the last entry only partially written
+	require.NoError(t, ioutil.WriteFile(sum.journalPath(), []byte(`{"key":"b","value":"2"}
+{"key":"a","value":"3"}
+{"key":"c","va`), 0644))
+
+	require.NoError(t, sum.ReadWrite(context.TODO(), func(ctx context.Context, tr storage.Transaction) error {
+		values, err := tr.ReadValues(ctx, []string{"a", "b", "c"})
+		assert.Equal(t, []string{"3", "2", ""}, values)
+		return err
+	}))
+	content, err := ioutil.ReadFile(sum.Path)
+	require.NoError(t, err)
+	assert.Equal(t, "a: \"3\"\nb: \"2\"\n", string(content))
+}
+
+func TestYamlSumStorageFileLock(t *testing.T) {
+	d, err := ioutil.TempDir("", "go-make")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(d) }()
+	path := filepath.Join(d, "go-make.sum")
+
+	// concurrent read-modify-write transactions must not lose updates
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sum := &YamlSumStorageFile{Path: path}
+			for k := 0; k < 10; k++ {
+				assert.NoError(t, sum.ReadWrite(context.TODO(), func(ctx context.Context, tr storage.Transaction) error {
+					v, err := tr.ReadValue(ctx, "count")
+					if err != nil {
+						return err
+					}
+					n, _ := strconv.Atoi(v)
+					return tr.BufferWrites([]storage.Write{{Key: "count", Value: strconv.Itoa(n + 1)}})
+				}))
+			}
+		}()
+	}
+	wg.Wait()
+	content, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "count: \"40\"\n", string(content))
+
+	locked := make(chan struct{})
+	release := make(chan struct{})
+	go func() {
+		_ = (&YamlSumStorageFile{Path: path}).ReadWrite(context.TODO(), func(ctx context.Context, tr storage.Transaction) error {
+			close(locked)
+			<-release
+			return nil
+		})
+	}()
+	<-locked
+	noop := func(ctx context.Context, tr storage.Transaction) error { return nil }
+	assert.Equal(t, ErrLocked, (&YamlSumStorageFile{Path: path, LockTimeout: -1}).ReadOnly(context.TODO(), noop))
+	assert.Equal(t, ErrLocked, (&YamlSumStorageFile{Path: path, LockTimeout: 100 * time.Millisecond}).ReadWrite(context.TODO(), noop))
+	close(release)
+	assert.NoError(t, (&YamlSumStorageFile{Path: path}).ReadWrite(context.TODO(), noop))
+}
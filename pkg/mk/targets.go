@@ -2,9 +2,15 @@ package mk
 
 import (
 	"fmt"
+	"github.com/pkg/errors"
 	"net/url"
+	"path/filepath"
+	"strings"
 )
 
+// ErrUnknownScheme is returned when parsing a target URL with a scheme no target type is registered for
+var ErrUnknownScheme = fmt.Errorf("unknown target scheme")
+
 type targetFactory struct {
 	factories map[string]func(url.URL) Target
 }
@@ -20,6 +26,49 @@ func (tf *targetFactory) RegisterTarget(scheme string, factory func(url.URL) Tar
 	tf.factories[scheme] = factory
 }
 
+// ParseTarget creates a target from its name using the factory registered for the scheme of the
+// name. Names without a scheme are paths of file targets.
+func (tf *targetFactory) ParseTarget(name string) (Target, error) {
+	if !hasScheme(name) {
+		return &FileTarget{Path: filepath.FromSlash(name)}, nil
+	}
+	scheme := name[:strings.IndexByte(name, ':')]
+	u, err := url.Parse(name)
+	if err != nil {
+		// names of file targets with relative paths are not always valid URLs, as their first
+		// segment takes the place of the host (file://a%20b.txt)
+		u = &url.URL{Scheme: strings.ToLower(scheme), Opaque: name[len(scheme)+1:]}
+	}
+	factory, ok := tf.factories[u.Scheme]
+	if !ok {
+		return nil, errors.Wrapf(ErrUnknownScheme, "error parsing target '%s'", name)
+	}
+	return factory(*u), nil
+}
+
+// hasScheme tells whether a name starts with a URL scheme. Single letters are taken as windows
+// drive letters rather than schemes.
+func hasScheme(name string) bool {
+	i := strings.IndexByte(name, ':')
+	if i < 2 {
+		return false
+	}
+	for k, c := range name[:i] {
+		switch {
+		case 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z':
+		case k > 0 && ('0' <= c && c <= '9' || c == '+' || c == '-' || c == '.'):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
 func RegisterTarget(scheme string, factory func(url.URL) Target) {
 	defaultTargetFactory.RegisterTarget(scheme, factory)
 }
+
+// ParseTarget creates a target from its name using the registered target types, see RegisterTarget
+func ParseTarget(name string) (Target, error) {
+	return defaultTargetFactory.ParseTarget(name)
+}
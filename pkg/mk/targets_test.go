@@ -0,0 +1,38 @@
+package mk
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestParseTarget(t *testing.T) {
+	for _, target := range []Target{
+		&FileTarget{Path: "a.txt"},
+		&FileTarget{Path: "Dir/sub/a.txt"},
+		&FileTarget{Path: "/abs/a.txt"},
+		&FileTarget{Path: "../a.txt"},
+		&FileTarget{Path: "a b:c?d#e%f.txt"},
+		&PhonyTarget{Label: "all"},
+		&PhonyTarget{Label: "with space"},
+	} {
+		parsed, err := ParseTarget(target.Name())
+		require.NoError(t, err, target.Name())
+		assert.Equal(t, target, parsed, target.Name())
+	}
+
+	for name, target := range map[string]Target{
+		"a.txt":          &FileTarget{Path: "a.txt"},
+		"dir/a:b.txt":    &FileTarget{Path: "dir/a:b.txt"},
+		"file:dir/a.txt": &FileTarget{Path: "dir/a.txt"},
+		"phony:all":      &PhonyTarget{Label: "all"},
+	} {
+		parsed, err := ParseTarget(name)
+		require.NoError(t, err, name)
+		assert.Equal(t, target, parsed, name)
+	}
+
+	_, err := ParseTarget("unknown:foo")
+	assert.True(t, errors.Is(err, ErrUnknownScheme))
+}
@@ -0,0 +1,106 @@
+package mk
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// ChromeTrace is an EventSink timing how long each worker spends checking targets and executing
+// their recipes. The timings are written in the Chrome Trace Event Format, to be viewed e.g. with
+// chrome://tracing or Perfetto, with one lane per worker.
+type ChromeTrace struct {
+	lock    sync.Mutex
+	start   time.Time
+	open    map[string]traceEvent
+	workers map[int]bool
+	events  []traceEvent
+}
+
+// traceEvent is an event of the Chrome Trace Event Format, times are in microseconds
+type traceEvent struct {
+	Name  string            `json:"name"`
+	Cat   string            `json:"cat,omitempty"`
+	Ph    string            `json:"ph"`
+	Ts    int64             `json:"ts"`
+	Dur   int64             `json:"dur"`
+	Pid   int               `json:"pid"`
+	Tid   int               `json:"tid"`
+	Args  map[string]string `json:"args,omitempty"`
+	begin time.Time
+}
+
+func (c *ChromeTrace) Event(e Event) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.start.IsZero() {
+		c.start = e.Time
+		c.open = make(map[string]traceEvent)
+		c.workers = make(map[int]bool)
+	}
+	if e.Worker < 0 || e.Target == nil {
+		return
+	}
+	name := e.Target.Name()
+	switch e.Kind {
+	case EventStarted:
+		if !c.workers[e.Worker] {
+			c.workers[e.Worker] = true
+			c.events = append(c.events, traceEvent{
+				Name: "thread_name",
+				Ph:   "M",
+				Tid:  e.Worker,
+				Args: map[string]string{"name": fmt.Sprintf("worker %d", e.Worker)},
+			})
+		}
+		c.open[name] = traceEvent{Name: name, Cat: "check", Tid: e.Worker, begin: e.Time}
+	case EventExecuting:
+		c.finish(name, e.Time, nil)
+		c.open[name] = traceEvent{
+			Name:  name,
+			Cat:   "recipe",
+			Tid:   e.Worker,
+			Args:  map[string]string{"reason": e.Reason.String()},
+			begin: e.Time,
+		}
+	case EventSucceeded:
+		c.finish(name, e.Time, nil)
+	case EventFailed:
+		c.finish(name, e.Time, map[string]string{"error": fmt.Sprint(e.Err)})
+	}
+}
+
+// finish completes the open span of a target
+func (c *ChromeTrace) finish(name string, end time.Time, args map[string]string) {
+	ev, ok := c.open[name]
+	if !ok {
+		return
+	}
+	delete(c.open, name)
+	ev.Ph = "X"
+	ev.Ts = ev.begin.Sub(c.start).Microseconds()
+	ev.Dur = end.Sub(ev.begin).Microseconds()
+	for k, v := range args {
+		if ev.Args == nil {
+			ev.Args = make(map[string]string)
+		}
+		ev.Args[k] = v
+	}
+	c.events = append(c.events, ev)
+}
+
+// Write writes the trace of the events received so far
+func (c *ChromeTrace) Write(w io.Writer) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	events := c.events
+	if events == nil {
+		events = []traceEvent{}
+	}
+	return json.NewEncoder(w).Encode(struct {
+		TraceEvents     []traceEvent `json:"traceEvents"`
+		DisplayTimeUnit string       `json:"displayTimeUnit"`
+	}{events, "ms"})
+}
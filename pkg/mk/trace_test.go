@@ -0,0 +1,64 @@
+package mk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestChromeTrace(t *testing.T) {
+	a, b := &ttarget{"a"}, &ttarget{"b"}
+	start := time.Unix(100, 0)
+	at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+	trace := &ChromeTrace{}
+	for _, e := range []Event{
+		{Kind: EventGraphComputed, Time: at(0), Worker: -1, Targets: 2},
+		{Kind: EventQueued, Time: at(0), Target: b, Worker: -1},
+		{Kind: EventStarted, Time: at(1), Target: b, Worker: 0},
+		{Kind: EventUpToDate, Time: at(2), Target: b, Worker: 0},
+		{Kind: EventSucceeded, Time: at(3), Target: b, Worker: 0},
+		{Kind: EventQueued, Time: at(3), Target: a, Worker: -1},
+		{Kind: EventStarted, Time: at(4), Target: a, Worker: 1},
+		{Kind: EventExecuting, Time: at(5), Target: a, Worker: 1, Reason: Reason{Kind: ReasonRecipeChanged}},
+		{Kind: EventFailed, Time: at(15), Target: a, Worker: 1, Err: errFailed},
+	} {
+		trace.Event(e)
+	}
+
+	var out bytes.Buffer
+	require.NoError(t, trace.Write(&out))
+	var parsed struct {
+		TraceEvents []traceEvent `json:"traceEvents"`
+	}
+	require.NoError(t, json.Unmarshal(out.Bytes(), &parsed))
+	assert.Equal(t, []traceEvent{
+		{Name: "thread_name", Ph: "M", Args: map[string]string{"name": "worker 0"}},
+		{Name: "b", Cat: "check", Ph: "X", Ts: 1000, Dur: 2000},
+		{Name: "thread_name", Ph: "M", Tid: 1, Args: map[string]string{"name": "worker 1"}},
+		{Name: "a", Cat: "check", Ph: "X", Ts: 4000, Dur: 1000, Tid: 1},
+		{Name: "a", Cat: "recipe", Ph: "X", Ts: 5000, Dur: 10000, Tid: 1,
+			Args: map[string]string{"reason": "recipe changed", "error": "failed"}},
+	}, parsed.TraceEvents)
+}
+
+func TestChromeTraceMake(t *testing.T) {
+	fs := newTestFS(map[string]string{"c": "c"})
+	trace := &ChromeTrace{}
+	m := &Make{
+		Sum:    testSum(t),
+		Rules:  []Rule{&testRule{fs: fs, prereqs: map[string][]string{"a": {"b"}, "b": {"c"}}}},
+		Events: trace,
+	}
+	require.NoError(t, m.Make(nil, context.TODO(), &testTarget{"a", fs}))
+	var spans []string
+	for _, e := range trace.events {
+		if e.Ph == "X" {
+			spans = append(spans, e.Cat+" "+e.Name)
+		}
+	}
+	assert.Equal(t, []string{"check c", "check b", "recipe b", "check a", "recipe a"}, spans)
+}